@@ -1,83 +1,157 @@
 package combind
 
 import (
+	"encoding"
 	"encoding/json"
+	"reflect"
+	"strconv"
 )
 
 func MergeArr(m1 []Key, m2 []Key) []Key {
-	result := []Key{}
+	result := make([]Key, 0, len(m1)*len(m2))
 
 	for _, mv1 := range m1 {
 		for _, mv2 := range m2 {
 			if k, ok := MergeKey(mv1, mv2); ok {
 				result = append(result, k)
 			}
-			if k, ok := MergeKey(mv2, mv1); ok {
-				result = append(result, k)
-			}
 		}
 	}
 
-	return DedupKeys(result)
+	if len(result) < 2 {
+		return result
+	}
+	return dedupMergedKeys(result)
 }
 
-func MergeKey(m1 Key, m2 Key) (Key, bool) {
+// dedupMergedKeys removes duplicates from keys produced by MergeKey, which only
+// hold string values, reusing its buffers between keys
+func dedupMergedKeys(keys []Key) []Key {
+	seen := make(map[string]struct{}, len(keys))
+	names := []string{}
+	buf := []byte{}
+	result := keys[:0]
 
-	b1, err := json.Marshal(m1)
-	if err != nil {
-		return Key{}, false
-	}
-	b2, err := json.Marshal(m2)
-	if err != nil {
-		return Key{}, false
-	}
+	for _, k := range keys {
+		names = names[:0]
+		for name := range k {
+			names = append(names, name)
+		}
+		// insertion sort, keys are small and sort.Strings would allocate
+		for i := 1; i < len(names); i++ {
+			for j := i; j > 0 && names[j] < names[j-1]; j-- {
+				names[j], names[j-1] = names[j-1], names[j]
+			}
+		}
 
-	m1Map := map[string]string{}
-	m2Map := map[string]string{}
+		buf = buf[:0]
+		for _, name := range names {
+			buf = appendLengthPrefixed(buf, name)
+			buf = appendLengthPrefixed(buf, k[name].(string))
+		}
 
-	if err := json.Unmarshal(b1, &m1Map); err != nil {
-		return Key{}, false
-	}
-	if err := json.Unmarshal(b2, &m2Map); err != nil {
-		return Key{}, false
+		if _, ok := seen[string(buf)]; ok {
+			continue
+		}
+		seen[string(buf)] = struct{}{}
+		result = append(result, k)
 	}
 
-	for k, v1 := range m1Map {
-		if v2, ok := m2Map[k]; ok && v1 != v2 {
+	return result
+}
+
+func appendLengthPrefixed(buf []byte, s string) []byte {
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, ':')
+	return append(buf, s...)
+}
+
+// MergeKey merges two keys whose values are strings, rejecting keys that
+// disagree on a shared field. Values are compared as their JSON string
+// representation, nil counts as the empty string and any other value makes
+// the merge fail
+func MergeKey(m1 Key, m2 Key) (Key, bool) {
+	result := make(Key, len(m1)+len(m2))
+
+	for k, v1 := range m1 {
+		v1, ok := keyValue(v1)
+		if !ok {
 			return Key{}, false
 		}
+		result[k] = v1
 	}
-	for k, v2 := range m2Map {
-		if v1, ok := m1Map[k]; ok && v1 != v2 {
+
+	for k, v2 := range m2 {
+		v2, ok := keyValue(v2)
+		if !ok {
+			return Key{}, false
+		}
+		if v1, ok := result[k]; ok && v1 != v2 {
 			return Key{}, false
 		}
+		result[k] = v2
 	}
 
-	for k, v2 := range m2Map {
-		m1Map[k] = v2
+	return result, true
+}
+
+// keyValue normalizes a key value to a plain string, reusing the value when it
+// already is one to avoid allocating
+func keyValue(v interface{}) (interface{}, bool) {
+	if _, ok := v.(string); ok {
+		return v, true
 	}
+	s, ok := keyString(v)
+	if !ok {
+		return nil, false
+	}
+	return s, true
+}
 
-	var resultKey Key
-	rb, err := json.Marshal(m1Map)
-	if err != nil {
-		return Key{}, false
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// keyString returns the string a key value decodes to when round tripped
+// through JSON into a string, and whether it does so at all
+func keyString(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case nil:
+		return "", true
 	}
 
-	if err := json.Unmarshal(rb, &resultKey); err != nil {
-		return Key{}, false
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.String && !t.Implements(jsonMarshalerType) && !t.Implements(textMarshalerType) {
+		return reflect.ValueOf(v).String(), true
 	}
 
-	return resultKey, true
+	// values with custom marshaling are rare, take the slow path
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return "", false
+	}
+	return s, true
 }
 
+// DedupKeys removes duplicate keys, keeping the first occurrence of each. Keys
+// are the same when their Hash is, as for the stored documents and the diffs
 func DedupKeys(d []Key) []Key {
-	dedupMatches := map[string]map[string]interface{}{}
+	seen := make(map[string]bool, len(d))
+	matches := make([]Key, 0, len(d))
 	for _, match := range d {
-		dedupMatches[Hash(match)] = match
-	}
-	matches := []Key{}
-	for _, key := range dedupMatches {
-		matches = append(matches, key)
+		h := Hash(match)
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		matches = append(matches, match)
 	}
 
 	return matches
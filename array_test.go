@@ -0,0 +1,167 @@
+package combind_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type code string
+
+// jsonMergeKey is the original JSON based MergeKey, kept as reference and baseline
+func jsonMergeKey(m1 combind.Key, m2 combind.Key) (combind.Key, bool) {
+	b1, err := json.Marshal(m1)
+	if err != nil {
+		return combind.Key{}, false
+	}
+	b2, err := json.Marshal(m2)
+	if err != nil {
+		return combind.Key{}, false
+	}
+
+	m1Map := map[string]string{}
+	m2Map := map[string]string{}
+
+	if err := json.Unmarshal(b1, &m1Map); err != nil {
+		return combind.Key{}, false
+	}
+	if err := json.Unmarshal(b2, &m2Map); err != nil {
+		return combind.Key{}, false
+	}
+
+	for k, v1 := range m1Map {
+		if v2, ok := m2Map[k]; ok && v1 != v2 {
+			return combind.Key{}, false
+		}
+	}
+
+	for k, v2 := range m2Map {
+		m1Map[k] = v2
+	}
+
+	var resultKey combind.Key
+	rb, err := json.Marshal(m1Map)
+	if err != nil {
+		return combind.Key{}, false
+	}
+
+	if err := json.Unmarshal(rb, &resultKey); err != nil {
+		return combind.Key{}, false
+	}
+
+	return resultKey, true
+}
+
+func TestMergeKeyMatchesJSONMerge(t *testing.T) {
+	keys := []combind.Key{
+		{},
+		{"brand": "volvo"},
+		{"brand": "saab"},
+		{"brand": "volvo", "model": "v70"},
+		{"model": "v70"},
+		{"model": code("v70")},
+		{"model": nil},
+		{"year": 2020},
+		{"year": "2020"},
+		{"year": true},
+		{"brand": "volvo", "nested": map[string]interface{}{"a": "b"}},
+	}
+
+	for _, k1 := range keys {
+		for _, k2 := range keys {
+			expected, expectedOk := jsonMergeKey(k1, k2)
+			actual, ok := combind.MergeKey(k1, k2)
+			assert.Equal(t, expectedOk, ok, "%v %v", k1, k2)
+			assert.Equal(t, expected, actual, "%v %v", k1, k2)
+		}
+	}
+}
+
+func TestMergeArrRejectsConflictingKeys(t *testing.T) {
+	merged := combind.MergeArr(
+		[]combind.Key{{"brand": "volvo"}, {"brand": "saab"}},
+		[]combind.Key{{"brand": "volvo", "model": "v70"}, {"brand": "saab", "model": "9-5"}, {"model": "xc90"}},
+	)
+
+	assert.Equal(t, []combind.Key{
+		{"brand": "volvo", "model": "v70"},
+		{"brand": "volvo", "model": "xc90"},
+		{"brand": "saab", "model": "9-5"},
+		{"brand": "saab", "model": "xc90"},
+	}, merged)
+}
+
+func TestDedupKeysMatchesStoredDocuments(t *testing.T) {
+	ctx := context.Background()
+	matches := []combind.Key{{"year": 2020}, {"year": "2020"}, {"year": 2021}}
+
+	deduped := combind.DedupKeys(matches)
+	assert.Equal(t, []combind.Key{{"year": 2020}, {"year": 2021}}, deduped)
+
+	boxes := combind.NewMemorySearchBoxStorage()
+	assert.NoError(t, boxes.Save(ctx, &combind.SearchBox{Key: "v70", Type: "model", Matches: matches}))
+	found, err := boxes.Find(ctx, "model")
+	assert.NoError(t, err)
+	if assert.Len(t, found, 1) {
+		assert.Len(t, found[0].Matches, len(deduped))
+	}
+}
+
+func benchmarkKeys(typ string, n int) []combind.Key {
+	keys := []combind.Key{}
+	for i := 0; i < n; i++ {
+		keys = append(keys, combind.Key{typ: fmt.Sprintf("%s%d", typ, i), "market": "se"})
+	}
+	return keys
+}
+
+func BenchmarkMergeKey(b *testing.B) {
+	k1 := combind.Key{"brand": "volvo", "market": "se"}
+	k2 := combind.Key{"model": "v70", "market": "se"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		combind.MergeKey(k1, k2)
+	}
+}
+
+func BenchmarkMergeKeyJSON(b *testing.B) {
+	k1 := combind.Key{"brand": "volvo", "market": "se"}
+	k2 := combind.Key{"model": "v70", "market": "se"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		jsonMergeKey(k1, k2)
+	}
+}
+
+func BenchmarkMergeArr(b *testing.B) {
+	m1 := benchmarkKeys("brand", 10)
+	m2 := benchmarkKeys("model", 10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		combind.MergeArr(m1, m2)
+	}
+}
+
+func BenchmarkMergeArrJSON(b *testing.B) {
+	m1 := benchmarkKeys("brand", 10)
+	m2 := benchmarkKeys("model", 10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		result := []combind.Key{}
+		for _, mv1 := range m1 {
+			for _, mv2 := range m2 {
+				if k, ok := jsonMergeKey(mv1, mv2); ok {
+					result = append(result, k)
+				}
+				if k, ok := jsonMergeKey(mv2, mv1); ok {
+					result = append(result, k)
+				}
+			}
+		}
+		combind.DedupKeys(result)
+	}
+}
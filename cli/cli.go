@@ -0,0 +1,286 @@
+// Package cli implements the combind command-line tool. The graph is either
+// registered by a host program, which builds its own binary:
+//
+//	func main() {
+//		cli.Register("cars", func(ctx context.Context) (*combind.Combind, error) {
+//			return combind.New(storage, cars), nil
+//		})
+//		cli.Main()
+//	}
+//
+// or defined in a config file passed with -config, see Config
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ourstudio-se/combind/v2"
+)
+
+// GraphFactory creates the graph the commands run against
+type GraphFactory func(ctx context.Context) (*combind.Combind, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]GraphFactory{}
+)
+
+// Register makes a graph available to the commands under a name, selected with -graph
+func Register(name string, factory GraphFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = factory
+}
+
+const usage = `usage: combind [-graph name | -config file] <command> [arguments]
+
+commands:
+  build               build every component and save the SearchBoxes
+  plan [-json]        show what build would change, without writing
+  inspect <type> <key>
+                      show a SearchBox and its matches
+  export [-o file]    dump the SearchBoxes of every type as NDJSON
+  components          list the component types and their roots
+`
+
+// ErrUsage is returned by Run for invalid command lines
+var ErrUsage = errors.New("invalid usage")
+
+// Main runs the command line of the process and exits with a non-zero status on failure
+func Main() {
+	if err := Run(context.Background(), os.Args[1:], os.Stdout); err != nil {
+		if errors.Is(err, ErrUsage) {
+			fmt.Fprint(os.Stderr, usage)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Run runs a command line, without the program name, writing the output to out
+func Run(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("combind", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	graph := flags.String("graph", "", "name of a registered graph")
+	config := flags.String("config", "", "path to a graph config file")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", ErrUsage, err)
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("%w: missing command", ErrUsage)
+	}
+
+	command, ok := commands[flags.Arg(0)]
+	if !ok {
+		return fmt.Errorf("%w: unknown command %s", ErrUsage, flags.Arg(0))
+	}
+
+	g, err := loadGraph(ctx, *graph, *config, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return command(ctx, g, flags.Args()[1:], out)
+}
+
+func loadGraph(ctx context.Context, name string, config string, command string) (*combind.Combind, error) {
+	if config != "" {
+		if name != "" {
+			return nil, fmt.Errorf("%w: -graph and -config are exclusive", ErrUsage)
+		}
+		cfg, err := LoadConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.SearchBoxes.Memory && readsSavedBoxes[command] {
+			return nil, fmt.Errorf("%s reads saved SearchBoxes, which searchboxes.memory does not keep between runs, use searchboxes.dir or an alias", command)
+		}
+		return cfg.Graph(ctx)
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if name == "" {
+		if len(registry) != 1 {
+			return nil, fmt.Errorf("%w: select a graph with -graph or -config", ErrUsage)
+		}
+		for n := range registry {
+			name = n
+		}
+	}
+
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: no graph registered as %s", ErrUsage, name)
+	}
+	return factory(ctx)
+}
+
+type command func(ctx context.Context, g *combind.Combind, args []string, out io.Writer) error
+
+var commands = map[string]command{
+	"build":      build,
+	"plan":       plan,
+	"inspect":    inspect,
+	"export":     export,
+	"components": components,
+}
+
+// readsSavedBoxes are the commands reading the SearchBoxes saved by an earlier build
+var readsSavedBoxes = map[string]bool{
+	"inspect": true,
+	"export":  true,
+}
+
+func build(ctx context.Context, g *combind.Combind, args []string, out io.Writer) error {
+	if len(args) > 0 {
+		return fmt.Errorf("%w: build takes no arguments", ErrUsage)
+	}
+	if err := g.Save(ctx); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(out, "saved", strings.Join(sortedTypes(g), ", "))
+	return err
+}
+
+func plan(ctx context.Context, g *combind.Combind, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	asJSON := flags.Bool("json", false, "render the plan as JSON")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return fmt.Errorf("%w: plan [-json]", ErrUsage)
+	}
+
+	p, err := g.Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		data, err := p.JSON()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	}
+	_, err = fmt.Fprint(out, p.Text())
+	return err
+}
+
+// searchBox is a SearchBox with its matches, as shown by inspect and export
+type searchBox struct {
+	Key     string                 `json:"key"`
+	Type    string                 `json:"type"`
+	Props   map[string]interface{} `json:"props"`
+	Matches []combind.Key          `json:"matches"`
+}
+
+func newSearchBox(sb *combind.SearchBox) *searchBox {
+	return &searchBox{
+		Key:     sb.Key,
+		Type:    sb.Type,
+		Props:   sb.Props,
+		Matches: sb.Matches,
+	}
+}
+
+// errInspected stops reading the boxes of a type once inspect passed the key
+var errInspected = errors.New("inspected")
+
+func inspect(ctx context.Context, g *combind.Combind, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return fmt.Errorf("%w: inspect <type> <key>", ErrUsage)
+	}
+
+	// the boxes are sorted on key, the search stops at the box or past its key
+	var box *searchBox
+	err := combind.FindEach(ctx, g.Storage(), args[0], func(sb *combind.SearchBox) error {
+		if sb.Key == args[1] {
+			box = newSearchBox(sb)
+		}
+		if sb.Key >= args[1] {
+			return errInspected
+		}
+		return nil
+	})
+	if err != nil && err != errInspected {
+		return err
+	}
+	if box == nil {
+		return fmt.Errorf("no SearchBox %s of type %s", args[1], args[0])
+	}
+
+	data, err := json.MarshalIndent(box, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+func export(ctx context.Context, g *combind.Combind, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	path := flags.String("o", "", "file to write to instead of stdout")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return fmt.Errorf("%w: export [-o file]", ErrUsage)
+	}
+
+	if *path == "" {
+		return exportDocuments(ctx, g, out)
+	}
+
+	f, err := os.Create(*path)
+	if err != nil {
+		return err
+	}
+	if err := exportDocuments(ctx, g, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportDocuments writes the SearchBoxes of every type, one JSON box per line
+func exportDocuments(ctx context.Context, g *combind.Combind, out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	for _, typ := range sortedTypes(g) {
+		err := combind.FindEach(ctx, g.Storage(), typ, func(sb *combind.SearchBox) error {
+			return encoder.Encode(newSearchBox(sb))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func components(ctx context.Context, g *combind.Combind, args []string, out io.Writer) error {
+	if len(args) > 0 {
+		return fmt.Errorf("%w: components takes no arguments", ErrUsage)
+	}
+	for _, typ := range sortedTypes(g) {
+		if _, err := fmt.Fprintf(out, "%s: %s\n", typ, strings.Join(g.Roots(typ), ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedTypes(g *combind.Combind) []string {
+	types := g.ComponentTypes()
+	sort.Strings(types)
+	return types
+}
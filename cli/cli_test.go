@@ -0,0 +1,219 @@
+package cli_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/ourstudio-se/combind/v2/cli"
+	"github.com/stretchr/testify/assert"
+)
+
+func registerBrands(name string) combind.SearchBoxStorage {
+	boxes := combind.NewMemorySearchBoxStorage()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+	cli.Register(name, func(ctx context.Context) (*combind.Combind, error) {
+		return combind.New(boxes, combind.NewRoot("brand", components)), nil
+	})
+	return boxes
+}
+
+func run(t *testing.T, args ...string) string {
+	out := &bytes.Buffer{}
+	assert.NoError(t, cli.Run(context.Background(), args, out))
+	return out.String()
+}
+
+func TestRegisteredGraph(t *testing.T) {
+	registerBrands("brands")
+
+	assert.Equal(t, "brand: brand\n", run(t, "-graph", "brands", "components"))
+	assert.Equal(t, "brand: 2 created, 0 changed, 0 removed boxes, 2 created, 0 removed matches\n"+
+		"  + saab (1 matches)\n"+
+		"  + volvo (1 matches)\n", run(t, "-graph", "brands", "plan"))
+
+	assert.Equal(t, "saved brand\n", run(t, "-graph", "brands", "build"))
+
+	inspected := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(run(t, "-graph", "brands", "inspect", "brand", "volvo")), &inspected))
+	assert.Equal(t, "volvo", inspected["key"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"brand": "volvo"}}, inspected["matches"])
+
+	lines := strings.Split(strings.TrimSpace(run(t, "-graph", "brands", "export")), "\n")
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		d := combind.SearchBox{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &d))
+		assert.Equal(t, "brand", d.Type)
+	}
+
+	path := filepath.Join(t.TempDir(), "export.ndjson")
+	assert.Equal(t, "", run(t, "-graph", "brands", "export", "-o", path))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join(lines, "\n")+"\n", string(data))
+
+	err = cli.Run(context.Background(), []string{"-graph", "brands", "inspect", "brand", "audi"}, &bytes.Buffer{})
+	assert.EqualError(t, err, "no SearchBox audi of type brand")
+}
+
+// countingStorage counts the SearchBoxes read with FindEach
+type countingStorage struct {
+	combind.StreamingSearchBoxStorage
+	read int
+}
+
+func (s *countingStorage) FindEach(ctx context.Context, boxType string, fn func(*combind.SearchBox) error) error {
+	return s.StreamingSearchBoxStorage.FindEach(ctx, boxType, func(sb *combind.SearchBox) error {
+		s.read++
+		return fn(sb)
+	})
+}
+
+func TestInspectStopsAtTheBox(t *testing.T) {
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "audi", Type: "brand", Name: "Audi"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+	)
+	boxes := &countingStorage{StreamingSearchBoxStorage: combind.NewMemorySearchBoxStorage().(combind.StreamingSearchBoxStorage)}
+	cli.Register("inspect", func(ctx context.Context) (*combind.Combind, error) {
+		return combind.New(boxes, combind.NewRoot("brand", components)), nil
+	})
+	run(t, "-graph", "inspect", "build")
+
+	inspected := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(run(t, "-graph", "inspect", "inspect", "brand", "audi")), &inspected))
+	assert.Equal(t, "audi", inspected["key"])
+	assert.Equal(t, 1, boxes.read)
+
+	err := cli.Run(context.Background(), []string{"-graph", "inspect", "inspect", "brand", "bmw"}, &bytes.Buffer{})
+	assert.EqualError(t, err, "no SearchBox bmw of type brand")
+	assert.Equal(t, 3, boxes.read)
+}
+
+func TestConfigGraph(t *testing.T) {
+	assert.Equal(t, "cars: brand, model\n", run(t, "-config", "testdata/graph.yaml", "components"))
+
+	plan := &combind.Plan{}
+	assert.NoError(t, json.Unmarshal([]byte(run(t, "-config", "testdata/graph.yaml", "plan", "-json")), plan))
+	assert.Len(t, plan.Types, 1)
+	assert.Equal(t, "cars", plan.Types[0].Type)
+
+	keys := []string{}
+	for _, c := range plan.Types[0].Created {
+		keys = append(keys, c.Key)
+	}
+	assert.Equal(t, []string{"volvo-v70", "volvo-xc90"}, keys)
+}
+
+func TestUsageErrors(t *testing.T) {
+	registerBrands("usage")
+
+	for _, args := range [][]string{
+		{},
+		{"-graph", "usage", "deploy"},
+		{"-graph", "missing", "build"},
+		{"-graph", "usage", "inspect", "brand"},
+		{"-graph", "usage", "-config", "testdata/graph.yaml", "build"},
+	} {
+		err := cli.Run(context.Background(), args, &bytes.Buffer{})
+		assert.True(t, errors.Is(err, cli.ErrUsage), "%v: %v", args, err)
+	}
+}
+
+func TestConfigFileStorage(t *testing.T) {
+	testdata, err := filepath.Abs("testdata")
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	config := filepath.Join(dir, "graph.yaml")
+	assert.NoError(t, ioutil.WriteFile(config, []byte(`components:
+  file: `+filepath.Join(testdata, "components.json")+`
+searchboxes:
+  dir: searchboxes
+roots: [brand, model]
+virtual:
+  - type: cars
+    dependencies: [brand, model]
+    rules: `+filepath.Join(testdata, "cars-rules.yaml")+`
+`), 0644))
+
+	assert.Equal(t, "saved cars\n", run(t, "-config", config, "build"))
+
+	inspected := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(run(t, "-config", config, "inspect", "cars", "volvo-v70")), &inspected))
+	assert.Equal(t, "volvo-v70", inspected["key"])
+	assert.Len(t, strings.Split(strings.TrimSpace(run(t, "-config", config, "export")), "\n"), 2)
+
+	versions, err := combind.SearchBoxFileVersions(filepath.Join(dir, "searchboxes"), "searchboxes")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+}
+
+func TestConfigMemoryStorageRejectsReads(t *testing.T) {
+	for _, command := range []string{"inspect", "export"} {
+		err := cli.Run(context.Background(), []string{"-config", "testdata/graph.yaml", command, "cars", "volvo-v70"}, &bytes.Buffer{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "searchboxes.memory")
+	}
+}
+
+// documentedConfig is the example of the Config documentation
+const documentedConfig = `elasticsearch:
+  url: http://localhost:9200
+components:
+  index: components
+searchboxes:
+  alias: searchboxes
+  prefix: searchboxes-
+roots: [brand, model]
+virtual:
+  - type: cars
+    combiner: join
+    dependencies: [brand, model]
+    rules: cars-rules.yaml
+    conflict_policy: highest-priority
+publish: [cars]
+`
+
+func TestLoadConfigElasticsearchURL(t *testing.T) {
+	dir := t.TempDir()
+	for config, urls := range map[string][]string{
+		documentedConfig: {"http://localhost:9200"},
+		"elasticsearch:\n  url: [http://es1:9200, http://es2:9200]\n":        {"http://es1:9200", "http://es2:9200"},
+		`{"elasticsearch": {"url": ["http://es1:9200", "http://es2:9200"]}}`: {"http://es1:9200", "http://es2:9200"},
+	} {
+		path := filepath.Join(dir, "graph.yaml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0644))
+
+		cfg, err := cli.LoadConfig(path)
+		if assert.NoError(t, err, config) {
+			assert.Equal(t, cli.URLs(urls), cfg.Elasticsearch.URL, config)
+		}
+	}
+}
+
+func TestLoadConfigRejectsUnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	for _, config := range []string{
+		strings.Replace(documentedConfig, "conflict_policy", "conflict_polcy", 1),
+		strings.Replace(documentedConfig, "publish", "publsh", 1),
+		strings.Replace(documentedConfig, "    conflict_policy", "    max_rule_hits: 2\n    conflict_policy", 1),
+		`{"roots": ["brand"], "publsh": ["brand"]}`,
+	} {
+		path := filepath.Join(dir, "graph.yaml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0644))
+
+		_, err := cli.LoadConfig(path)
+		assert.Error(t, err, config)
+	}
+}
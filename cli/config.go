@@ -0,0 +1,332 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/ourstudio-se/combind/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config defines a graph in YAML or JSON, built from root components, virtual
+// components with declarative rules and the built-in combiners:
+//
+//	elasticsearch:
+//	  url: http://localhost:9200
+//	components:
+//	  index: components
+//	searchboxes:
+//	  alias: searchboxes
+//	  prefix: searchboxes-
+//	roots: [brand, model]
+//	virtual:
+//	  - type: cars
+//	    combiner: join
+//	    dependencies: [brand, model]
+//	    rules: cars-rules.yaml
+//	    conflict_policy: highest-priority
+//	publish: [cars]
+//
+// The url of Elasticsearch is a single URL or a list of them. Components are
+// read from an Elasticsearch index, or from a JSON file with an array of
+// backend components. SearchBoxes are saved behind an
+// Elasticsearch alias, in versioned NDJSON files in a directory, see
+// combind.NewFileSearchBoxStorage, or in memory. Memory is not kept between
+// runs, so inspect and export reject it. Rule files, see
+// combind.RuleDefinitions, component files and the SearchBox directory are
+// relative to the config file. The combiner is join or cartesian, join being the default, cartesian
+// also passes combinations without compatible matches to the rules. Publish
+// lists the component types of the graph and defaults to every virtual
+// component
+type Config struct {
+	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch" json:"elasticsearch"`
+	Components    ComponentsConfig    `yaml:"components" json:"components"`
+	SearchBoxes   SearchBoxesConfig   `yaml:"searchboxes" json:"searchboxes"`
+	Roots         []string            `yaml:"roots" json:"roots"`
+	Virtual       []VirtualConfig     `yaml:"virtual" json:"virtual"`
+	Publish       []string            `yaml:"publish" json:"publish"`
+
+	dir string
+}
+
+// ElasticsearchConfig is the cluster used by the storages
+type ElasticsearchConfig struct {
+	URL URLs `yaml:"url" json:"url"`
+}
+
+// URLs is a list of URLs, configured as a list or as a single URL
+type URLs []string
+
+// UnmarshalYAML reads a single URL or a list of URLs
+func (u *URLs) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*u = URLs{value.Value}
+		return nil
+	}
+	urls := []string{}
+	if err := value.Decode(&urls); err != nil {
+		return err
+	}
+	*u = urls
+	return nil
+}
+
+// ComponentsConfig is where the backend components are read from
+type ComponentsConfig struct {
+	Index string `yaml:"index" json:"index"`
+	File  string `yaml:"file" json:"file"`
+}
+
+// SearchBoxesConfig is where the SearchBoxes are saved
+type SearchBoxesConfig struct {
+	Alias  string `yaml:"alias" json:"alias"`
+	Dir    string `yaml:"dir" json:"dir"`
+	Prefix string `yaml:"prefix" json:"prefix"`
+	Memory bool   `yaml:"memory" json:"memory"`
+}
+
+// defaultFilePrefix names the SearchBox files of a directory without prefix
+const defaultFilePrefix = "searchboxes"
+
+// VirtualConfig defines a virtual component
+type VirtualConfig struct {
+	Type           string   `yaml:"type" json:"type"`
+	Combiner       string   `yaml:"combiner" json:"combiner"`
+	Dependencies   []string `yaml:"dependencies" json:"dependencies"`
+	Rules          string   `yaml:"rules" json:"rules"`
+	Workers        int      `yaml:"workers" json:"workers"`
+	MaxRulesHits   int      `yaml:"max_rules_hits" json:"max_rules_hits"`
+	ConflictPolicy string   `yaml:"conflict_policy" json:"conflict_policy"`
+}
+
+var combiners = map[string]func(...combind.CombinerOption) combind.ContextCombiner{
+	"":          combind.JoinCombiner,
+	"join":      combind.JoinCombiner,
+	"cartesian": combind.CartesianCombiner,
+}
+
+var conflictPolicies = map[string]combind.ConflictPolicy{
+	"":                 combind.ConflictFirstWins,
+	"first-wins":       combind.ConflictFirstWins,
+	"all":              combind.ConflictAll,
+	"highest-priority": combind.ConflictHighestPriority,
+	"error":            combind.ConflictError,
+}
+
+// LoadConfig reads a graph config from a YAML or JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	// unknown fields are rejected, a misspelled field would otherwise build the graph with its default
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not parse config %s: %w", path, err)
+	}
+	cfg.dir = filepath.Dir(path)
+
+	return cfg, nil
+}
+
+// Graph creates the storages and components of the config and a validated Combind of them
+func (cfg *Config) Graph(ctx context.Context) (*combind.Combind, error) {
+	var client *elastic.Client
+	if cfg.Components.Index != "" || cfg.SearchBoxes.Alias != "" {
+		c, err := elastic.NewClient(elastic.SetURL(cfg.Elasticsearch.URL...), elastic.SetSniff(false))
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to elasticsearch: %w", err)
+		}
+		client = c
+	}
+
+	componentStorage, err := cfg.componentStorage(client)
+	if err != nil {
+		return nil, err
+	}
+
+	searchBoxStorage, err := cfg.searchBoxStorage(client)
+	if err != nil {
+		return nil, err
+	}
+
+	components, err := cfg.components(componentStorage)
+	if err != nil {
+		return nil, err
+	}
+
+	publish := cfg.Publish
+	if len(publish) == 0 {
+		for _, v := range cfg.Virtual {
+			publish = append(publish, v.Type)
+		}
+	}
+
+	graph := []combind.Component{}
+	for _, typ := range publish {
+		c, ok := components[typ]
+		if !ok {
+			return nil, fmt.Errorf("published type %s is not defined", typ)
+		}
+		graph = append(graph, c)
+	}
+
+	return combind.NewWithConfiguration(searchBoxStorage, graph, combind.WithValidation())
+}
+
+func (cfg *Config) componentStorage(client *elastic.Client) (combind.ComponentStorage, error) {
+	switch {
+	case cfg.Components.Index != "" && cfg.Components.File != "":
+		return nil, fmt.Errorf("components from both an index and a file")
+	case cfg.Components.Index != "":
+		return combind.NewElasticComponentStorage(client, cfg.Components.Index), nil
+	case cfg.Components.File != "":
+		data, err := ioutil.ReadFile(cfg.path(cfg.Components.File))
+		if err != nil {
+			return nil, err
+		}
+		backend := []*combind.BackendComponent{}
+		if err := json.Unmarshal(data, &backend); err != nil {
+			return nil, fmt.Errorf("could not parse components %s: %w", cfg.Components.File, err)
+		}
+		return combind.NewMemoryComponentStorage(backend...), nil
+	default:
+		return nil, fmt.Errorf("components without index or file")
+	}
+}
+
+func (cfg *Config) searchBoxStorage(client *elastic.Client) (combind.SearchBoxStorage, error) {
+	storages := 0
+	for _, set := range []bool{cfg.SearchBoxes.Alias != "", cfg.SearchBoxes.Dir != "", cfg.SearchBoxes.Memory} {
+		if set {
+			storages++
+		}
+	}
+
+	switch {
+	case storages > 1:
+		return nil, fmt.Errorf("searchboxes in more than one of an alias, a dir and memory")
+	case cfg.SearchBoxes.Alias != "":
+		return combind.NewElasticSearchBoxStorage(client, cfg.SearchBoxes.Alias, cfg.SearchBoxes.Prefix), nil
+	case cfg.SearchBoxes.Dir != "":
+		prefix := cfg.SearchBoxes.Prefix
+		if prefix == "" {
+			prefix = defaultFilePrefix
+		}
+		return combind.NewFileSearchBoxStorage(cfg.path(cfg.SearchBoxes.Dir), prefix), nil
+	case cfg.SearchBoxes.Memory:
+		return combind.NewMemorySearchBoxStorage(), nil
+	default:
+		return nil, fmt.Errorf("searchboxes without alias, dir or memory")
+	}
+}
+
+// components creates every root and virtual component, keyed on type
+func (cfg *Config) components(storage combind.ComponentStorage) (map[string]combind.Component, error) {
+	components := map[string]combind.Component{}
+	for _, typ := range cfg.Roots {
+		if _, ok := components[typ]; ok {
+			return nil, fmt.Errorf("duplicate component type %s", typ)
+		}
+		components[typ] = combind.NewRoot(typ, storage)
+	}
+
+	virtual := map[string]VirtualConfig{}
+	for _, v := range cfg.Virtual {
+		if _, ok := components[v.Type]; ok {
+			return nil, fmt.Errorf("duplicate component type %s", v.Type)
+		}
+		if _, ok := virtual[v.Type]; ok {
+			return nil, fmt.Errorf("duplicate component type %s", v.Type)
+		}
+		virtual[v.Type] = v
+	}
+
+	building := map[string]bool{}
+	var create func(typ string) (combind.Component, error)
+	create = func(typ string) (combind.Component, error) {
+		if c, ok := components[typ]; ok {
+			return c, nil
+		}
+		v, ok := virtual[typ]
+		if !ok {
+			return nil, fmt.Errorf("component type %s is not defined", typ)
+		}
+		if building[typ] {
+			return nil, fmt.Errorf("dependency cycle on type %s", typ)
+		}
+		building[typ] = true
+
+		dependencies := []combind.Component{}
+		for _, d := range v.Dependencies {
+			c, err := create(d)
+			if err != nil {
+				return nil, err
+			}
+			dependencies = append(dependencies, c)
+		}
+
+		c, err := cfg.virtual(v, dependencies)
+		if err != nil {
+			return nil, fmt.Errorf("virtual component %s: %w", typ, err)
+		}
+		components[typ] = c
+		return c, nil
+	}
+
+	for _, v := range cfg.Virtual {
+		if _, err := create(v.Type); err != nil {
+			return nil, err
+		}
+	}
+
+	return components, nil
+}
+
+func (cfg *Config) virtual(v VirtualConfig, dependencies []combind.Component) (combind.Component, error) {
+	combiner, ok := combiners[v.Combiner]
+	if !ok {
+		return nil, fmt.Errorf("unknown combiner %s", v.Combiner)
+	}
+	policy, ok := conflictPolicies[v.ConflictPolicy]
+	if !ok {
+		return nil, fmt.Errorf("unknown conflict policy %s", v.ConflictPolicy)
+	}
+
+	options := []combind.VirtualComponentConfiguration{
+		combind.WithContextCombiner(combiner()),
+		combind.WithDependency(dependencies...),
+		combind.WithConflictPolicy(policy),
+	}
+	if v.Rules != "" {
+		defs, err := combind.LoadRuleDefinitions(cfg.path(v.Rules))
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, combind.WithRuleDefinitions(defs))
+	}
+	if v.Workers > 0 {
+		options = append(options, combind.WithWorkers(v.Workers))
+	}
+	if v.MaxRulesHits > 0 {
+		options = append(options, combind.WithMaxRulesHits(v.MaxRulesHits))
+	}
+
+	return combind.NewVirtualComponent(v.Type, nil, options...), nil
+}
+
+func (cfg *Config) path(file string) string {
+	if filepath.IsAbs(file) || cfg.dir == "" {
+		return file
+	}
+	return filepath.Join(cfg.dir, file)
+}
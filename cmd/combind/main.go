@@ -0,0 +1,12 @@
+// Command combind builds, plans and inspects a combind graph defined in a
+// config file, see cli.Config. Host programs registering their own graph
+// build their own binary with cli.Register and cli.Main
+package main
+
+import (
+	"github.com/ourstudio-se/combind/v2/cli"
+)
+
+func main() {
+	cli.Main()
+}
@@ -2,9 +2,10 @@ package combind
 
 import (
 	"context"
+	"runtime"
+	"sort"
 	"time"
 
-	"github.com/google/go-cmp/cmp"
 	"github.com/reveald/reveald"
 	log "github.com/sirupsen/logrus"
 )
@@ -14,31 +15,80 @@ type Combind struct {
 	components    map[string]Component
 	searchStorage SearchBoxStorage
 	roots         map[string][]string
+	validate      bool
+	concurrency   int
+	observer      Observer
 }
 
 type CombindFrontend struct {
 	components map[string]Component
 	roots      map[string][]string
+	validate   bool
+}
+
+// CombindConfiguration configures a Combind created with NewWithConfiguration
+type CombindConfiguration func(*Combind)
+
+// CombindFrontendConfiguration configures a CombindFrontend created with NewCombindFrontendWithConfiguration
+type CombindFrontendConfiguration func(*CombindFrontend)
+
+// WithValidation validates the component graph when the Combind is created
+func WithValidation() CombindConfiguration {
+	return func(g *Combind) {
+		g.validate = true
+	}
+}
+
+// WithConcurrency limits how many components Save builds in parallel
+func WithConcurrency(concurrency int) CombindConfiguration {
+	return func(g *Combind) {
+		g.concurrency = concurrency
+	}
+}
+
+// WithFrontendValidation validates the component graph when the CombindFrontend is created
+func WithFrontendValidation() CombindFrontendConfiguration {
+	return func(g *CombindFrontend) {
+		g.validate = true
+	}
 }
 
 type CombinerBuilder interface {
-	Update(ctx context.Context, comps ...*BackendComponent) ([]*SearchBox, error)
+	Update(ctx context.Context, comps ...*BackendComponent) (BuildDiff, error)
 	Save(ctx context.Context) error
+	Plan(ctx context.Context) (*Plan, error)
 }
 
 func NewCombindFrontend(components ...Component) *CombindFrontend {
+	g, _ := NewCombindFrontendWithConfiguration(components)
+	return g
+}
+
+// NewCombindFrontendWithConfiguration creates a frontend for the components,
+// failing if the configuration asks for validation and the graph is invalid
+func NewCombindFrontendWithConfiguration(components []Component, cfg ...CombindFrontendConfiguration) (*CombindFrontend, error) {
 
 	g := &CombindFrontend{
 		components: map[string]Component{},
 		roots:      map[string][]string{},
 	}
 
+	for _, c := range cfg {
+		c(g)
+	}
+
+	if g.validate {
+		if err := Validate(components...); err != nil {
+			return nil, err
+		}
+	}
+
 	for _, c := range components {
 		g.roots[c.Type()] = getComponentRoots(c)
 		g.components[c.Type()] = c
 	}
 
-	return g
+	return g, nil
 }
 
 func (combiner *CombindFrontend) Process(builder *reveald.QueryBuilder, next reveald.FeatureFunc) (*reveald.Result, error) {
@@ -72,21 +122,40 @@ func (combiner *CombindFrontend) handle(result *reveald.Result) (*reveald.Result
 func New(
 	combindStorage SearchBoxStorage,
 	components ...Component) *Combind {
+	g, _ := NewWithConfiguration(combindStorage, components)
+	return g
+}
+
+// NewWithConfiguration creates a Combind for the components, failing if the
+// configuration asks for validation and the graph is invalid
+func NewWithConfiguration(
+	combindStorage SearchBoxStorage,
+	components []Component,
+	cfg ...CombindConfiguration) (*Combind, error) {
 
 	g := &Combind{
 		searchStorage: combindStorage,
 		components:    map[string]Component{},
 		roots:         map[string][]string{},
+		concurrency:   runtime.NumCPU(),
 	}
 
-	g.roots = map[string][]string{}
+	for _, c := range cfg {
+		c(g)
+	}
+
+	if g.validate {
+		if err := Validate(components...); err != nil {
+			return nil, err
+		}
+	}
 
 	for _, c := range components {
 		g.roots[c.Type()] = getComponentRoots(c)
 		g.components[c.Type()] = c
 	}
 
-	return g
+	return g, nil
 }
 
 func (g *Combind) ComponentTypes() []string {
@@ -98,88 +167,164 @@ func (g *Combind) ComponentTypes() []string {
 	return res
 }
 
-//Save the graph to the provided storage
+// Roots returns the sorted types of the root components a component of the graph is built from
+func (g *Combind) Roots(componentType string) []string {
+	roots := append([]string{}, g.roots[componentType]...)
+	sort.Strings(roots)
+	return roots
+}
+
+// Storage returns the storage the graph saves its SearchBoxes to
+func (g *Combind) Storage() SearchBoxStorage {
+	return g.searchStorage
+}
+
+//Save builds every component of the graph exactly once, in dependency order,
+//and streams the boxes of the top level components into the provided storage
+//while the rest of the graph is still being built, when the storage is a
+//StreamingSearchBoxStorage. Top level components no other component depends
+//on send their boxes as they build them, see StreamingComponent, virtual
+//components spool their matches to disk until the Props of their boxes are
+//resolved. The builds of dependencies are held for their dependents. The
+//memory storage holds every document, as it is the storage, the file storage
+//spools them to disk
 func (g *Combind) Save(ctx context.Context) error {
 
-	logTime := func(part string, start time.Time) {
-		end := time.Now()
-		log.Debugf("%s took %d MS", part, end.Sub(start).Milliseconds())
+	start := time.Now()
+	defer func() {
+		log.Debugf("Total runtime took %d MS", time.Since(start).Milliseconds())
+	}()
+
+	ctx, done := observe(g.observed(ctx), g.Name())
+	session, err := newBuildSession(g.topLevel(), g.concurrency)
+	if err != nil {
+		done(0, err)
+		return err
 	}
 
-	defer logTime("Total runtime", time.Now())
-	results := []*SearchBox{}
-	for typ, comp := range g.components {
-		start := time.Now()
-		log.Debugf("Running %s", typ)
-		result, err := comp.Build(ctx, true)
-		if err != nil {
-			return err
-		}
+	boxes := 0
+	var buildErr error
+	err = saveEach(ctx, g.searchStorage, func(emit func(*SearchBox) error) error {
+		buildErr = session.stream(ctx, func(sb *SearchBox) error {
+			boxes++
+			return emit(sb)
+		})
+		return buildErr
+	})
+	done(boxes, buildErr)
+	if err != nil && buildErr == nil {
+		log.Error("Error saving", err)
+	}
+	return err
+}
 
-		logTime(typ, start)
-		results = append(results, result...)
+// buildTypes builds the graph in a session and returns the boxes of every top level component type
+func (g *Combind) buildTypes(ctx context.Context) (map[string][]*SearchBox, error) {
+	session, err := newBuildSession(g.topLevel(), g.concurrency)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.run(ctx); err != nil {
+		return nil, err
 	}
 
-	if err := g.searchStorage.Save(ctx, results...); err != nil {
-		log.Error("Error saving", err)
-		return err
+	results := map[string][]*SearchBox{}
+	for _, c := range g.topLevel() {
+		results[c.Type()] = session.result(c.Type())
+	}
+	return results, nil
+}
+
+// observed returns a context notifying the observer of the graph, if any
+func (g *Combind) observed(ctx context.Context) context.Context {
+	if g.observer == nil {
+		return ctx
+	}
+	return ContextWithObserver(ctx, g.observer)
+}
+
+// topLevel returns the components of the graph sorted on type
+func (g *Combind) topLevel() []Component {
+	components := []Component{}
+	for _, typ := range g.sortedTypes() {
+		components = append(components, g.components[typ])
+	}
+	return components
+}
+
+func (g *Combind) sortedTypes() []string {
+	types := []string{}
+	for typ := range g.components {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Update recomputes every component built from the changed backend components
+// and returns what changed compared to the SearchBoxes currently in storage.
+// Like Save it refreshes every affected component exactly once, in dependency
+// order, and passes the keys of the boxes that changed to its dependents
+func (combiner *Combind) Update(ctx context.Context, comps ...*BackendComponent) (BuildDiff, error) {
+	ctx = combiner.observed(ctx)
+	changes := ChangesOf(comps...)
+
+	session, err := newBuildSession(combiner.topLevel(), 1)
+	if err != nil {
+		return nil, err
+	}
+	order, err := session.order()
+	if err != nil {
+		return nil, err
 	}
-	return nil
-}
-
-// Update recomputes the updates for the graph
-func (combiner *Combind) Update(ctx context.Context, comps ...*BackendComponent) ([]*SearchBox, error) {
-	deletedBoxes := []*SearchBox{}
-	updatedBoxes := []*SearchBox{}
-	createdBoxes := []*SearchBox{}
-
-	for key, component := range combiner.components {
-		roots := getComponentRoots(component)
-		for _, comp := range comps {
-			for _, root := range roots {
-
-				if root == comp.Type {
-
-					boxes, err := combiner.searchStorage.Find(ctx, key)
-					if err != nil {
-						return nil, err
-					}
-					builds, err := component.Build(ctx, true)
-					if err != nil {
-						return nil, err
-					}
-
-					builtIndex := map[string]*SearchBox{}
-					existingIndex := map[string]*SearchBox{}
-
-					for _, builtBox := range builds {
-						builtIndex[builtBox.Key] = builtBox
-					}
-
-					for _, existingBox := range boxes {
-						existingIndex[existingBox.Key] = &existingBox
-					}
-
-					for k, build := range builtIndex {
-						if existingIndex[k] == nil {
-							createdBoxes = append(createdBoxes, build)
-						} else if !cmp.Equal(existingIndex[k], build) {
-							updatedBoxes = append(updatedBoxes, build)
-						}
-					}
-
-					for k, existingBox := range existingIndex {
-						if builtIndex[k] == nil {
-							//todo: handle this
-							_ = append(deletedBoxes, existingBox)
-						}
-					}
-				}
+
+	// the keys of the changed boxes per refreshed dependency type, nil when unknown
+	changed := map[string]map[string]bool{}
+	diff := BuildDiff{}
+	for _, typ := range order {
+		n := session.nodes[typ]
+		if !changes.affects(n.component) {
+			continue
+		}
+
+		var previous []*SearchBox
+		known := true
+		if len(n.dependents) > 0 {
+			previous, known, err = previousBuild(ctx, n.component)
+			if err != nil {
+				return nil, err
 			}
 		}
+		builds, err := refreshComponent(ctx, n.component, changes, changed)
+		if err != nil {
+			return nil, err
+		}
+		if len(n.dependents) > 0 {
+			changed[typ] = changedBoxKeys(n.component, changes, previous, known, builds)
+		}
+
+		if n.topLevel {
+			existing, err := combiner.searchStorage.Find(ctx, typ)
+			if err != nil {
+				return nil, err
+			}
+			diff[typ] = diffSearchBoxes(searchBoxPointers(existing), builds)
+		}
 	}
 
-	return append(updatedBoxes, createdBoxes...), nil
+	return diff, nil
+}
+
+// refreshComponent rebuilds a component for the changes once its dependencies are refreshed
+func refreshComponent(ctx context.Context, component Component, changes Changes, changed map[string]map[string]bool) ([]*SearchBox, error) {
+	switch c := component.(type) {
+	case *VirtualComponent:
+		return c.refreshChanged(ctx, changed)
+	case IncrementalComponent:
+		return c.BuildIncremental(ctx, changes)
+	default:
+		return component.Build(ctx, true)
+	}
 }
 
 func getComponentRoots(comp Component) []string {
@@ -0,0 +1,298 @@
+package combind_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateReportsCreatedUpdatedAndDeleted(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+	boxes := combind.NewMemorySearchBoxStorage()
+
+	g := combind.New(boxes, combind.NewRoot("brand", components))
+	assert.NoError(t, g.Save(ctx))
+
+	audi := &combind.BackendComponent{Code: "audi", Type: "brand", Name: "Audi"}
+	volvo := &combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo Cars"}
+	saab := &combind.BackendComponent{Code: "saab", Type: "brand"}
+	assert.NoError(t, components.Save(ctx, audi, volvo))
+	assert.NoError(t, components.Delete(ctx, saab))
+
+	diff, err := g.Update(ctx, audi, volvo, saab)
+	assert.NoError(t, err)
+
+	brands := diff["brand"]
+	assert.Len(t, brands.Created, 1)
+	assert.Equal(t, "audi", brands.Created[0].Key)
+	assert.Len(t, brands.Updated, 1)
+	assert.Equal(t, "volvo", brands.Updated[0].Key)
+	assert.Len(t, brands.Deleted, 1)
+	assert.Equal(t, "saab", brands.Deleted[0].Key)
+}
+
+func TestUpdateAfterSaveReportsVirtualComponentChanges(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "v70", Type: "model", Name: "V70", Props: map[string]interface{}{"brand": "volvo"}},
+	)
+	boxes := combind.NewMemorySearchBoxStorage()
+
+	g := combind.New(boxes, brandModelComponent(components))
+	assert.NoError(t, g.Save(ctx))
+
+	xc90 := &combind.BackendComponent{Code: "xc90", Type: "model", Name: "XC90", Props: map[string]interface{}{"brand": "volvo"}}
+	assert.NoError(t, components.Save(ctx, xc90))
+
+	diff, err := g.Update(ctx, xc90)
+	assert.NoError(t, err)
+
+	models := diff["brand-model"]
+	if assert.NotNil(t, models) && assert.Len(t, models.Created, 1) {
+		assert.Equal(t, "xc90", models.Created[0].Key)
+	}
+	assert.Empty(t, models.Deleted)
+}
+
+func copyComponent(typ string, dependency combind.Component) *combind.VirtualComponent {
+	return combind.NewVirtualComponent(typ, nil,
+		combind.WithContextCombiner(func(ctx context.Context, deps map[string][]*combind.SearchBox) chan *combind.Combination {
+			return combind.DependencyMergeContext(ctx, nil, deps[dependency.Type()])
+		}),
+		combind.WithDependency(dependency),
+		combind.WithRule(func(c *combind.Combination) (*combind.SearchBox, bool) {
+			sb := c.Types[dependency.Type()]
+			return &combind.SearchBox{Key: sb.Key, Type: typ, Matches: c.Matches}, true
+		}),
+	)
+}
+
+func TestUpdateRefreshesSharedDependenciesOnce(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "v70", Type: "model", Name: "V70", Props: map[string]interface{}{"brand": "volvo"}},
+	)
+	boxes := combind.NewMemorySearchBoxStorage()
+
+	bm := brandModelComponent(components)
+	g := combind.New(boxes, bm, copyComponent("a", bm), copyComponent("b", bm))
+	assert.NoError(t, g.Save(ctx))
+
+	xc90 := &combind.BackendComponent{Code: "xc90", Type: "model", Name: "XC90", Props: map[string]interface{}{"brand": "volvo"}}
+	assert.NoError(t, components.Save(ctx, xc90))
+	diff, err := g.Update(ctx, xc90)
+	assert.NoError(t, err)
+	for _, typ := range []string{"brand-model", "a", "b"} {
+		if assert.NotNil(t, diff[typ], typ) && assert.Len(t, diff[typ].Created, 1, typ) {
+			assert.Equal(t, "xc90", diff[typ].Created[0].Key, typ)
+		}
+	}
+
+	// the incremental refresh of brand-model is seen by both of its dependents
+	v70 := &combind.BackendComponent{Code: "v70", Type: "model"}
+	assert.NoError(t, components.Delete(ctx, v70))
+	diff, err = g.Update(ctx, v70)
+	assert.NoError(t, err)
+	for _, typ := range []string{"brand-model", "a", "b"} {
+		if assert.NotNil(t, diff[typ], typ) && assert.Len(t, diff[typ].Deleted, 1, typ) {
+			assert.Equal(t, "v70", diff[typ].Deleted[0].Key, typ)
+		}
+	}
+}
+
+func TestUpdateIgnoresUnrelatedComponents(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+	)
+	boxes := combind.NewMemorySearchBoxStorage()
+
+	g := combind.New(boxes, combind.NewRoot("brand", components))
+	assert.NoError(t, g.Save(ctx))
+
+	diff, err := g.Update(ctx, &combind.BackendComponent{Code: "v70", Type: "model"})
+	assert.NoError(t, err)
+	assert.True(t, diff.Empty())
+}
+
+type countingComponent struct {
+	combind.Component
+	mu     sync.Mutex
+	builds int
+}
+
+func (c *countingComponent) Build(ctx context.Context, rebuild bool) ([]*combind.SearchBox, error) {
+	c.mu.Lock()
+	if rebuild {
+		c.builds++
+	}
+	c.mu.Unlock()
+	return c.Component.Build(ctx, rebuild)
+}
+
+func TestSaveBuildsEveryComponentOnce(t *testing.T) {
+	ctx := context.Background()
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "red", Type: "color", Name: "Red"},
+		&combind.BackendComponent{Code: "blue", Type: "color", Name: "Blue"},
+	)
+	brand := &countingComponent{Component: combind.NewRoot("brand", storage)}
+	color := &countingComponent{Component: combind.NewRoot("color", storage)}
+
+	combiner := func(deps map[string][]*combind.SearchBox) chan *combind.Combination {
+		return combind.DependencyMerge(nil, deps["brand"], deps["color"])
+	}
+	rule := func(typ string) combind.Rule {
+		return func(c *combind.Combination) (*combind.SearchBox, bool) {
+			return &combind.SearchBox{
+				Key:     c.Types["brand"].Key + "-" + c.Types["color"].Key,
+				Type:    typ,
+				Matches: c.Matches,
+			}, true
+		}
+	}
+	first := &countingComponent{Component: combind.NewVirtualComponent("first", combiner,
+		combind.WithDependency(brand, color), combind.WithRule(rule("first")))}
+	second := &countingComponent{Component: combind.NewVirtualComponent("second", combiner,
+		combind.WithDependency(brand, color), combind.WithRule(rule("second")))}
+
+	boxes := combind.NewMemorySearchBoxStorage()
+	g, err := combind.NewWithConfiguration(boxes,
+		[]combind.Component{first, second, brand},
+		combind.WithConcurrency(4),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, g.Save(ctx))
+
+	for _, c := range []*countingComponent{brand, color, first, second} {
+		assert.Equal(t, 1, c.builds, c.Type())
+	}
+
+	found, err := boxes.Find(ctx, "second")
+	assert.NoError(t, err)
+	assert.Len(t, found, 2)
+}
+
+// signallingStorage closes received once SaveEach got a box of the type
+type signallingStorage struct {
+	combind.StreamingSearchBoxStorage
+	boxType  string
+	received chan struct{}
+}
+
+func (s *signallingStorage) SaveEach(ctx context.Context, source combind.SearchBoxSource) error {
+	once := sync.Once{}
+	return s.StreamingSearchBoxStorage.SaveEach(ctx, func(emit func(*combind.SearchBox) error) error {
+		return source(func(sb *combind.SearchBox) error {
+			if sb.Type == s.boxType {
+				once.Do(func() { close(s.received) })
+			}
+			return emit(sb)
+		})
+	})
+}
+
+func TestSaveStreamsBoxesWhileBuilding(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "v70", Type: "model", Name: "V70"},
+	)
+	storage := &signallingStorage{
+		StreamingSearchBoxStorage: combind.NewMemorySearchBoxStorage().(combind.StreamingSearchBoxStorage),
+		boxType:                   "brand",
+		received:                  make(chan struct{}),
+	}
+
+	model := combind.NewRoot("model", components)
+	cars := combind.NewVirtualComponent("cars", nil, combind.WithContextCombiner(combind.CartesianCombiner()),
+		combind.WithDependency(model),
+		combind.WithRule(func(c *combind.Combination) (*combind.SearchBox, bool) {
+			select {
+			case <-storage.received:
+			case <-time.After(5 * time.Second):
+				t.Error("brand boxes were not saved before cars was built")
+			}
+			return &combind.SearchBox{Key: c.Types["model"].Key, Type: "cars", Matches: c.Matches}, true
+		}))
+
+	g, err := combind.NewWithConfiguration(storage,
+		[]combind.Component{combind.NewRoot("brand", components), cars},
+		combind.WithConcurrency(2),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, g.Save(ctx))
+
+	for typ, key := range map[string]string{"brand": "volvo", "cars": "v70"} {
+		found, err := storage.Find(ctx, typ)
+		assert.NoError(t, err)
+		if assert.Len(t, found, 1, typ) {
+			assert.Equal(t, key, found[0].Key)
+		}
+	}
+}
+
+type failingComponent struct {
+	combind.Component
+}
+
+func (c *failingComponent) Build(ctx context.Context, rebuild bool) ([]*combind.SearchBox, error) {
+	return nil, errors.New("build failed")
+}
+
+func TestSaveKeepsStorageWhenBuildFails(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+	)
+	boxes := combind.NewMemorySearchBoxStorage()
+	assert.NoError(t, boxes.Save(ctx, &combind.SearchBox{Key: "saab", Type: "brand", Matches: []combind.Key{{"brand": "saab"}}}))
+
+	g := combind.New(boxes,
+		combind.NewRoot("brand", components),
+		&failingComponent{Component: combind.NewRoot("model", components)},
+	)
+	assert.EqualError(t, g.Save(ctx), "build failed")
+
+	found, err := boxes.Find(ctx, "brand")
+	assert.NoError(t, err)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, "saab", found[0].Key)
+	}
+}
+
+// plainStorage only implements SearchBoxStorage, like storages written before StreamingSearchBoxStorage
+type plainStorage struct {
+	combind.SearchBoxStorage
+}
+
+func TestSaveAndFindEachWithoutStreamingStorage(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+	storage := plainStorage{SearchBoxStorage: combind.NewMemorySearchBoxStorage()}
+
+	assert.NoError(t, combind.New(storage, combind.NewRoot("brand", components)).Save(ctx))
+
+	keys := []string{}
+	err := combind.FindEach(ctx, storage, "brand", func(sb *combind.SearchBox) error {
+		keys = append(keys, sb.Key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"saab", "volvo"}, keys)
+}
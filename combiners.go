@@ -0,0 +1,143 @@
+package combind
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// CartesianCombiner combines every box of every dependency with every box of
+// the others, in type order and box order. Every combination is sent, the
+// Matches of a combination without any compatible match are empty, so rules
+// see combinations JoinCombiner never produces
+func CartesianCombiner(opts ...CombinerOption) ContextCombiner {
+	options := newCombinerOptions(opts)
+	return func(ctx context.Context, dependency map[string][]*SearchBox) chan *Combination {
+		return cartesianDependencies(ctx, options, sortedDependencies(dependency)...)
+	}
+}
+
+// CartesianDependencies is the cartesian product of the dependencies behind CartesianCombiner
+func CartesianDependencies(ctx context.Context, dependencies ...[]*SearchBox) chan *Combination {
+	return cartesianDependencies(ctx, combinerOptions{}, dependencies...)
+}
+
+func cartesianDependencies(ctx context.Context, options combinerOptions, dependencies ...[]*SearchBox) chan *Combination {
+	results := make(chan *Combination, options.bufferSize)
+
+	go func() {
+		defer close(results)
+		if len(dependencies) == 0 {
+			return
+		}
+
+		picked := make([]*SearchBox, len(dependencies))
+		var combine func(i int, matches []Key) bool
+		combine = func(i int, matches []Key) bool {
+			if i == len(dependencies) {
+				ts := map[string]*SearchBox{}
+				for _, sb := range picked {
+					ts[sb.Type] = sb
+				}
+				return sendCombination(ctx, results, &Combination{
+					Types:   ts,
+					Matches: matches,
+				})
+			}
+
+			for _, sb := range dependencies[i] {
+				next := sb.Matches
+				if i > 0 {
+					next = MergeArr(matches, sb.Matches)
+				}
+				picked[i] = sb
+				if !combine(i+1, next) {
+					return false
+				}
+			}
+			return true
+		}
+		combine(0, nil)
+	}()
+
+	return results
+}
+
+// FilteredCombiner passes on the combinations of combiner accepted by predicate
+func FilteredCombiner(combiner ContextCombiner, predicate func(*Combination) bool, opts ...CombinerOption) ContextCombiner {
+	options := newCombinerOptions(opts)
+	return func(ctx context.Context, dependency map[string][]*SearchBox) chan *Combination {
+		in := combiner(ctx, dependency)
+		results := make(chan *Combination, options.bufferSize)
+
+		go func() {
+			defer close(results)
+			for {
+				c, ok := receiveCombination(ctx, in)
+				if !ok {
+					return
+				}
+				if predicate(c) && !sendCombination(ctx, results, c) {
+					return
+				}
+			}
+		}()
+
+		return results
+	}
+}
+
+// UnionCombiner runs the combiners one after another and passes on every
+// distinct combination, i.e the same boxes with the same matches, once. It
+// passes combinations on unbuffered, the combiners buffer their own stages.
+// The signature of every combination is kept until the build ends, so memory
+// grows with the number of distinct combinations
+func UnionCombiner(combiners ...ContextCombiner) ContextCombiner {
+	return func(ctx context.Context, dependency map[string][]*SearchBox) chan *Combination {
+		results := make(chan *Combination)
+
+		go func() {
+			defer close(results)
+			seen := map[string]bool{}
+			for _, combiner := range combiners {
+				in := combiner(ctx, dependency)
+				for {
+					c, ok := receiveCombination(ctx, in)
+					if !ok {
+						break
+					}
+
+					signature := combinationSignature(c)
+					if seen[signature] {
+						continue
+					}
+					seen[signature] = true
+					if !sendCombination(ctx, results, c) {
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}()
+
+		return results
+	}
+}
+
+func combinationSignature(c *Combination) string {
+	parts := []string{}
+	for typ, sb := range c.Types {
+		parts = append(parts, CanonicalKey(Key{typ: sb.Key}))
+	}
+	sort.Strings(parts)
+
+	matches := []string{}
+	for _, m := range c.Matches {
+		matches = append(matches, CanonicalKey(m))
+	}
+	sort.Strings(matches)
+
+	return strings.Join(parts, "") + "|" + strings.Join(matches, "")
+}
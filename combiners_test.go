@@ -0,0 +1,144 @@
+package combind_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type pinnedCombination struct {
+	Boxes   map[string]string
+	Matches []combind.Key
+}
+
+func pinCombinations(ch chan *combind.Combination) []pinnedCombination {
+	pinned := []pinnedCombination{}
+	for c := range ch {
+		boxes := map[string]string{}
+		for typ, sb := range c.Types {
+			boxes[typ] = sb.Key
+		}
+		pinned = append(pinned, pinnedCombination{Boxes: boxes, Matches: c.Matches})
+	}
+	return pinned
+}
+
+func marketDependencies() map[string][]*combind.SearchBox {
+	brands, models, markets := marketBoxes()
+	return map[string][]*combind.SearchBox{
+		"brand":  brands,
+		"model":  models,
+		"market": markets,
+	}
+}
+
+var pinnedMarketCombinations = []pinnedCombination{
+	{
+		Boxes:   map[string]string{"brand": "volvo", "market": "nordics", "model": "v70"},
+		Matches: []combind.Key{{"brand": "volvo", "market": "se", "model": "v70"}, {"brand": "volvo", "market": "no", "model": "v70"}},
+	},
+	{
+		Boxes:   map[string]string{"brand": "volvo", "market": "global", "model": "v70"},
+		Matches: []combind.Key{{"brand": "volvo", "market": "any", "model": "v70"}},
+	},
+	{
+		Boxes:   map[string]string{"brand": "volvo", "market": "global", "model": "xc90"},
+		Matches: []combind.Key{{"brand": "volvo", "market": "any", "model": "xc90"}},
+	},
+	{
+		Boxes:   map[string]string{"brand": "saab", "market": "nordics", "model": "9-5"},
+		Matches: []combind.Key{{"brand": "saab", "market": "se", "model": "9-5"}},
+	},
+	{
+		Boxes:   map[string]string{"brand": "saab", "market": "global", "model": "9-5"},
+		Matches: []combind.Key{{"brand": "saab", "market": "any", "model": "9-5"}},
+	},
+}
+
+func TestCartesianCombiner(t *testing.T) {
+	combiner := combind.CartesianCombiner()
+	pinned := pinCombinations(combiner(context.Background(), marketDependencies()))
+
+	boxes := []map[string]string{}
+	compatible := []pinnedCombination{}
+	for _, c := range pinned {
+		boxes = append(boxes, c.Boxes)
+		if len(c.Matches) > 0 {
+			compatible = append(compatible, c)
+		}
+	}
+	assert.Equal(t, []map[string]string{
+		{"brand": "volvo", "market": "nordics", "model": "v70"},
+		{"brand": "volvo", "market": "nordics", "model": "xc90"},
+		{"brand": "volvo", "market": "nordics", "model": "9-5"},
+		{"brand": "volvo", "market": "global", "model": "v70"},
+		{"brand": "volvo", "market": "global", "model": "xc90"},
+		{"brand": "volvo", "market": "global", "model": "9-5"},
+		{"brand": "saab", "market": "nordics", "model": "v70"},
+		{"brand": "saab", "market": "nordics", "model": "xc90"},
+		{"brand": "saab", "market": "nordics", "model": "9-5"},
+		{"brand": "saab", "market": "global", "model": "v70"},
+		{"brand": "saab", "market": "global", "model": "xc90"},
+		{"brand": "saab", "market": "global", "model": "9-5"},
+	}, boxes)
+	assert.Equal(t, pinnedMarketCombinations, compatible)
+}
+
+func TestJoinCombiner(t *testing.T) {
+	combiner := combind.JoinCombiner()
+	assert.Equal(t, pinnedMarketCombinations, pinCombinations(combiner(context.Background(), marketDependencies())))
+}
+
+func TestFilteredCombiner(t *testing.T) {
+	combiner := combind.FilteredCombiner(combind.JoinCombiner(), func(c *combind.Combination) bool {
+		return c.Types["market"].Key == "nordics"
+	})
+
+	assert.Equal(t, []pinnedCombination{
+		pinnedMarketCombinations[0],
+		pinnedMarketCombinations[3],
+	}, pinCombinations(combiner(context.Background(), marketDependencies())))
+}
+
+func TestUnionCombiner(t *testing.T) {
+	market := func(key string) func(*combind.Combination) bool {
+		return func(c *combind.Combination) bool {
+			return c.Types["market"].Key == key
+		}
+	}
+	combiner := combind.UnionCombiner(
+		combind.FilteredCombiner(combind.JoinCombiner(), market("global")),
+		combind.JoinCombiner(),
+	)
+
+	assert.Equal(t, []pinnedCombination{
+		pinnedMarketCombinations[1],
+		pinnedMarketCombinations[2],
+		pinnedMarketCombinations[4],
+		pinnedMarketCombinations[0],
+		pinnedMarketCombinations[3],
+	}, pinCombinations(combiner(context.Background(), marketDependencies())))
+}
+
+func TestCombinerAsVirtualComponentDeclaration(t *testing.T) {
+	ctx := context.Background()
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand"},
+		&combind.BackendComponent{Code: "red", Type: "color"},
+		&combind.BackendComponent{Code: "blue", Type: "color"},
+	)
+
+	vc := combind.NewVirtualComponent("brand-color", nil, combind.WithContextCombiner(combind.CartesianCombiner()),
+		combind.WithDependency(combind.NewRoot("brand", storage), combind.NewRoot("color", storage)),
+	)
+
+	boxes, err := vc.Build(ctx, true)
+	assert.NoError(t, err)
+	assert.Len(t, boxes, 1)
+	assert.ElementsMatch(t, []combind.Key{
+		{"brand": "volvo", "color": "red"},
+		{"brand": "volvo", "color": "blue"},
+	}, boxes[0].Matches)
+}
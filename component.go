@@ -19,3 +19,38 @@ type Component interface {
 type SearchableComponent interface {
 	Find(context.Context, Key) (*SearchBox, error)
 }
+
+// StreamingComponent can send a full build one SearchBox at a time, while it is
+// still building. BuildEach does not keep the build, later builds start over.
+// A key can be sent several times, each time with matches not sent before
+type StreamingComponent interface {
+	Component
+	BuildEach(ctx context.Context, fn func(*SearchBox) error) error
+}
+
+// IncrementalComponent can refresh its previous build for a set of changed root codes
+type IncrementalComponent interface {
+	Component
+	BuildIncremental(ctx context.Context, changes Changes) ([]*SearchBox, error)
+}
+
+// Changes holds the changed codes per root component type
+type Changes map[string][]string
+
+// ChangesOf collects the changed codes of backend components per type
+func ChangesOf(comps ...*BackendComponent) Changes {
+	changes := Changes{}
+	for _, c := range comps {
+		changes[c.Type] = append(changes[c.Type], c.Code)
+	}
+	return changes
+}
+
+func (changes Changes) affects(comp Component) bool {
+	for _, root := range getComponentRoots(comp) {
+		if _, ok := changes[root]; ok {
+			return true
+		}
+	}
+	return false
+}
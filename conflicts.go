@@ -0,0 +1,237 @@
+package combind
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConflictPolicy decides which rules apply to a combination and whose Props a
+// SearchBox gets when several rules produce the same key
+type ConflictPolicy int
+
+const (
+	// ConflictFirstWins applies the rules in order until WithMaxRulesHits is
+	// reached, a box keeps the Props of the first registered rule producing it
+	ConflictFirstWins ConflictPolicy = iota
+	// ConflictAll applies every matching rule regardless of WithMaxRulesHits,
+	// a box gets the Props of all rules producing it, earlier rules winning
+	ConflictAll
+	// ConflictHighestPriority applies only the matching rules with the highest
+	// priority, see WithPriorityRule, a box keeps the Props of the highest
+	// priority rule producing it
+	ConflictHighestPriority
+	// ConflictError behaves like ConflictFirstWins but fails the build when
+	// rules produce the same key with different Props
+	ConflictError
+)
+
+// RuleConflict is a box key produced with different Props
+type RuleConflict struct {
+	Key         string                 `json:"key"`
+	FirstRule   string                 `json:"firstRule"`
+	FirstProps  map[string]interface{} `json:"firstProps"`
+	SecondRule  string                 `json:"secondRule"`
+	SecondProps map[string]interface{} `json:"secondProps"`
+}
+
+// RuleConflictError is returned by builds using ConflictError
+type RuleConflictError struct {
+	Type      string
+	Conflicts []RuleConflict
+}
+
+func (e *RuleConflictError) Error() string {
+	conflicts := []string{}
+	for _, c := range e.Conflicts {
+		conflicts = append(conflicts, fmt.Sprintf("%s (%s, %s)", c.Key, c.FirstRule, c.SecondRule))
+	}
+	return fmt.Sprintf("conflicting rules for %s: %s", e.Type, strings.Join(conflicts, ", "))
+}
+
+// WithConflictPolicy sets how rules producing the same key are resolved, the
+// default is ConflictFirstWins
+func WithConflictPolicy(policy ConflictPolicy) VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		vc.policy = policy
+	}
+}
+
+// WithPriorityRule adds a named rule with a priority, used by
+// ConflictHighestPriority. Rules added otherwise have priority 0
+func WithPriorityRule(name string, priority int, rule Rule) VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		vc.rules = append(vc.rules, namedRule{
+			name:     name,
+			rule:     rule,
+			index:    len(vc.rules),
+			priority: priority,
+		})
+	}
+}
+
+// Conflicts returns the keys produced with different Props in the last build
+func (vc *VirtualComponent) Conflicts() []RuleConflict {
+	conflicts := append([]RuleConflict{}, vc.conflicts...)
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		return conflicts[i].Key < conflicts[j].Key
+	})
+	return conflicts
+}
+
+type ruleResult struct {
+	rule   namedRule
+	result *SearchBox
+}
+
+// applicableRules evaluates the rules on a combination according to the policy
+func (vc *VirtualComponent) applicableRules(combination *Combination) []ruleResult {
+	matched := []ruleResult{}
+
+	switch vc.policy {
+	case ConflictAll:
+		for _, rule := range vc.rules {
+			if result, ok := rule.rule(combination); ok {
+				matched = append(matched, ruleResult{rule: rule, result: result})
+			}
+		}
+	case ConflictHighestPriority:
+		highest := 0
+		for _, rule := range vc.rules {
+			if result, ok := rule.rule(combination); ok {
+				if len(matched) == 0 || rule.priority > highest {
+					highest = rule.priority
+				}
+				matched = append(matched, ruleResult{rule: rule, result: result})
+			}
+		}
+		prioritized := []ruleResult{}
+		for _, m := range matched {
+			if m.rule.priority == highest && len(prioritized) < vc.maxNrMatches {
+				prioritized = append(prioritized, m)
+			}
+		}
+		matched = prioritized
+	default:
+		for _, rule := range vc.rules {
+			if result, ok := rule.rule(combination); ok {
+				matched = append(matched, ruleResult{rule: rule, result: result})
+				if len(matched) >= vc.maxNrMatches {
+					break
+				}
+			}
+		}
+	}
+
+	return matched
+}
+
+// boxOwner tracks the rule whose Props a box has and the Props every rule
+// produced for it
+type boxOwner struct {
+	rule  namedRule
+	rules map[int]namedRule
+	props map[int]map[string]interface{}
+	// kept boxes have the Props of a previous build, until a rule produces them again
+	kept bool
+}
+
+// place adds a rule result to results, resolving the Props of an existing box
+// with the same key. Must be called holding the results lock
+func (vc *VirtualComponent) place(results map[string]*SearchBox, rule namedRule, result *SearchBox) {
+	existing, ok := results[result.Key]
+	owner, owned := vc.owners[result.Key]
+	// a kept box gets the Props of the first rule producing it again
+	owned = owned && !owner.kept
+	if !ok || !owned {
+		owner = &boxOwner{
+			rule:  rule,
+			rules: map[int]namedRule{},
+			props: map[int]map[string]interface{}{},
+		}
+		vc.owners[result.Key] = owner
+	}
+	if !ok {
+		results[result.Key] = result
+		owner.rules[rule.index] = rule
+		owner.props[rule.index] = result.Props
+		return
+	}
+
+	for index, props := range owner.props {
+		// a rule producing a key with different Props from different combinations doesn't conflict with itself
+		if index == rule.index {
+			continue
+		}
+		if !sameProps(props, result.Props) {
+			vc.recordConflict(result.Key, owner.rules[index], props, rule, result.Props)
+		}
+	}
+	if _, ok := owner.props[rule.index]; !ok {
+		owner.rules[rule.index] = rule
+		owner.props[rule.index] = result.Props
+	}
+
+	outranks := !owned || rule.priority > owner.rule.priority ||
+		rule.priority == owner.rule.priority && rule.index < owner.rule.index
+
+	switch {
+	case vc.policy == ConflictAll && outranks:
+		existing.Props = Merge(existing.Props, result.Props)
+	case vc.policy == ConflictAll:
+		existing.Props = Merge(result.Props, existing.Props)
+	case outranks:
+		existing.Props = result.Props
+	}
+
+	if outranks {
+		owner.rule = rule
+	}
+}
+
+func (vc *VirtualComponent) recordConflict(key string, first namedRule, firstProps map[string]interface{}, second namedRule, secondProps map[string]interface{}) {
+	if second.index < first.index || second.index == first.index && second.name < first.name {
+		first, second = second, first
+		firstProps, secondProps = secondProps, firstProps
+	}
+
+	for _, c := range vc.conflicts {
+		if c.Key == key && c.FirstRule == first.name && c.SecondRule == second.name {
+			return
+		}
+	}
+
+	log.Warnf("Rules %s and %s produce %s of type %s with different props", first.name, second.name, key, vc.typ)
+	vc.conflicts = append(vc.conflicts, RuleConflict{
+		Key:         key,
+		FirstRule:   first.name,
+		FirstProps:  firstProps,
+		SecondRule:  second.name,
+		SecondProps: secondProps,
+	})
+}
+
+func (vc *VirtualComponent) conflictError() error {
+	if vc.policy != ConflictError || len(vc.conflicts) == 0 {
+		return nil
+	}
+	return &RuleConflictError{
+		Type:      vc.typ,
+		Conflicts: vc.Conflicts(),
+	}
+}
+
+func sameProps(a map[string]interface{}, b map[string]interface{}) bool {
+	pa, err := json.Marshal(Merge(a, nil))
+	if err != nil {
+		return false
+	}
+	pb, err := json.Marshal(Merge(b, nil))
+	if err != nil {
+		return false
+	}
+	return string(pa) == string(pb)
+}
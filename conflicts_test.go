@@ -0,0 +1,105 @@
+package combind_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func labelRule(label string) combind.Rule {
+	return func(c *combind.Combination) (*combind.SearchBox, bool) {
+		return &combind.SearchBox{
+			Key:     "cars",
+			Type:    "labels",
+			Props:   map[string]interface{}{"label": label, label: true},
+			Matches: c.Matches,
+		}, true
+	}
+}
+
+func buildLabels(t *testing.T, cfg ...combind.VirtualComponentConfiguration) (*combind.VirtualComponent, []*combind.SearchBox, error) {
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand"},
+		&combind.BackendComponent{Code: "saab", Type: "brand"},
+	)
+	cfg = append(cfg, combind.WithContextCombiner(combind.JoinCombiner()), combind.WithDependency(combind.NewRoot("brand", storage)))
+	vc := combind.NewVirtualComponent("labels", nil, cfg...)
+	boxes, err := vc.Build(context.Background(), true)
+	return vc, boxes, err
+}
+
+func TestConflictFirstWins(t *testing.T) {
+	vc, boxes, err := buildLabels(t,
+		combind.WithNamedRule("first", labelRule("first")),
+		combind.WithNamedRule("second", labelRule("second")),
+		combind.WithMaxRulesHits(1),
+	)
+	assert.NoError(t, err)
+	assert.Len(t, boxes, 1)
+	assert.Equal(t, map[string]interface{}{"label": "first", "first": true}, boxes[0].Props)
+	assert.Empty(t, vc.Conflicts())
+}
+
+func TestConflictAllReportsConflicts(t *testing.T) {
+	vc, boxes, err := buildLabels(t,
+		combind.WithNamedRule("first", labelRule("first")),
+		combind.WithNamedRule("second", labelRule("second")),
+		combind.WithMaxRulesHits(1),
+		combind.WithConflictPolicy(combind.ConflictAll),
+	)
+	assert.NoError(t, err)
+	assert.Len(t, boxes, 1)
+	assert.Equal(t, map[string]interface{}{"label": "first", "first": true, "second": true}, boxes[0].Props)
+	assert.Len(t, boxes[0].Matches, 2)
+	assert.Equal(t, []combind.RuleConflict{{
+		Key:         "cars",
+		FirstRule:   "first",
+		FirstProps:  map[string]interface{}{"label": "first", "first": true},
+		SecondRule:  "second",
+		SecondProps: map[string]interface{}{"label": "second", "second": true},
+	}}, vc.Conflicts())
+}
+
+func TestConflictHighestPriority(t *testing.T) {
+	_, boxes, err := buildLabels(t,
+		combind.WithNamedRule("first", labelRule("first")),
+		combind.WithPriorityRule("important", 10, labelRule("important")),
+		combind.WithPriorityRule("less-important", 5, labelRule("less-important")),
+		combind.WithConflictPolicy(combind.ConflictHighestPriority),
+	)
+	assert.NoError(t, err)
+	assert.Len(t, boxes, 1)
+	assert.Equal(t, map[string]interface{}{"label": "important", "important": true}, boxes[0].Props)
+}
+
+func TestConflictError(t *testing.T) {
+	_, _, err := buildLabels(t,
+		combind.WithNamedRule("first", labelRule("first")),
+		combind.WithNamedRule("second", labelRule("second")),
+		combind.WithConflictPolicy(combind.ConflictError),
+	)
+	conflictErr, ok := err.(*combind.RuleConflictError)
+	assert.True(t, ok)
+	assert.Equal(t, "labels", conflictErr.Type)
+	assert.Len(t, conflictErr.Conflicts, 1)
+}
+
+func TestConflictErrorIgnoresRuleConflictingWithItself(t *testing.T) {
+	vc, boxes, err := buildLabels(t,
+		combind.WithNamedRule("only", func(c *combind.Combination) (*combind.SearchBox, bool) {
+			return &combind.SearchBox{
+				Key:     "cars",
+				Type:    "labels",
+				Props:   map[string]interface{}{"brand": c.Types["brand"].Key},
+				Matches: c.Matches,
+			}, true
+		}),
+		combind.WithConflictPolicy(combind.ConflictError),
+	)
+	assert.NoError(t, err)
+	assert.Len(t, boxes, 1)
+	assert.Len(t, boxes[0].Matches, 2)
+	assert.Empty(t, vc.Conflicts())
+}
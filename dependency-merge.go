@@ -1,106 +1,202 @@
 package combind
 
 import (
-	"sync"
+	"context"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// CombinerOption configures the built-in combiners
+type CombinerOption func(*combinerOptions)
+
+type combinerOptions struct {
+	bufferSize int
+}
+
+// WithCombinerBufferSize sets the buffer size of the channels between the stages of a combiner
+func WithCombinerBufferSize(bufferSize int) CombinerOption {
+	return func(o *combinerOptions) {
+		o.bufferSize = bufferSize
+	}
+}
+
+func newCombinerOptions(opts []CombinerOption) combinerOptions {
+	o := combinerOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.bufferSize < 0 {
+		o.bufferSize = 0
+	}
+	return o
+}
+
+// DependencyMerge combines the boxes of the dependencies, see
+// DependencyMergeContext. It runs until every combination is received
 func DependencyMerge(results chan *Combination, dependencies ...[]*SearchBox) chan *Combination {
+	return DependencyMergeContext(context.Background(), results, dependencies...)
+}
+
+// DependencyMergeContext combines the boxes of the dependencies. Combinations
+// received from results are combined with the boxes of every dependency. When
+// results is nil or closed without sending, a single dependency makes every
+// box a combination, with two or more the combinations start from every pair
+// of the first two dependencies and are combined with the boxes of each
+// following dependency. Each stage runs in one goroutine and stops when ctx is
+// cancelled
+func DependencyMergeContext(ctx context.Context, results chan *Combination, dependencies ...[]*SearchBox) chan *Combination {
+	return dependencyMerge(ctx, combinerOptions{}, results, dependencies...)
+}
+
+func dependencyMerge(ctx context.Context, options combinerOptions, seed chan *Combination, dependencies ...[]*SearchBox) chan *Combination {
+	if seed == nil {
+		return mergeDependencies(ctx, options, dependencies...)
+	}
+
+	merged := make(chan *Combination, options.bufferSize)
+	go func() {
+		defer close(merged)
+		first, ok := receiveCombination(ctx, seed)
+		if !ok {
+			if ctx.Err() == nil {
+				forwardCombinations(ctx, mergeDependencies(ctx, options, dependencies...), merged)
+			}
+			return
+		}
+
+		seeded := make(chan *Combination, options.bufferSize)
+		go func() {
+			defer close(seeded)
+			if sendCombination(ctx, seeded, first) {
+				forwardCombinations(ctx, seed, seeded)
+			}
+		}()
+		results := seeded
+		for _, dependency := range dependencies {
+			results = mergeDependency(ctx, options, results, dependency)
+		}
+		forwardCombinations(ctx, results, merged)
+	}()
+	return merged
+}
+
+// mergeDependencies combines the boxes of the dependencies, starting from the first ones
+func mergeDependencies(ctx context.Context, options combinerOptions, dependencies ...[]*SearchBox) chan *Combination {
+	first := make(chan *Combination, options.bufferSize)
 	if len(dependencies) == 0 {
-		return results
+		close(first)
+		return first
 	}
 	if len(dependencies) == 1 {
-		resultChan := make(chan *Combination)
 		go func() {
-			defer close(resultChan)
-			wg := sync.WaitGroup{}
-			for r := range results {
-				for _, d := range dependencies[0] {
-					wg.Add(1)
-					go func(r *Combination, d *SearchBox) {
-						defer wg.Done()
-						ts := map[string]*SearchBox{
-							d.Type: d,
-						}
-						for _, t := range r.Types {
-							ts[t.Type] = t
-						}
-						matches := MergeArr(r.Matches, d.Matches)
-
-						if len(matches) == 0 {
-							return
-						}
-
-						resultChan <- &Combination{
-							Types:   ts,
-							Matches: matches,
-						}
-					}(r, d)
+			defer close(first)
+			for _, sb := range dependencies[0] {
+				if !sendCombination(ctx, first, &Combination{
+					Types: map[string]*SearchBox{
+						sb.Type: sb,
+					},
+					Matches: sb.Matches,
+				}) {
+					return
 				}
 			}
-			wg.Wait()
 		}()
-		return resultChan
+		return first
 	}
 
-	theseResults := make(chan *Combination)
-	wg := sync.WaitGroup{}
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
+		defer close(first)
+		count := 0
 		for _, sbi := range dependencies[0] {
 			for _, sbj := range dependencies[1] {
-				wg.Add(1)
-				go func(sbi *SearchBox, sbj *SearchBox) {
-					defer wg.Done()
-					theseResults <- &Combination{
-						Types: map[string]*SearchBox{
-							sbi.Type: sbi,
-							sbj.Type: sbj,
-						},
-						Matches: MergeArr(sbi.Matches, sbj.Matches),
-					}
-				}(sbi, sbj)
+				if count%10000 == 0 {
+					log.Debugf("Ran %d", count)
+				}
+				count++
+				if !sendCombination(ctx, first, &Combination{
+					Types: map[string]*SearchBox{
+						sbi.Type: sbi,
+						sbj.Type: sbj,
+					},
+					Matches: MergeArr(sbi.Matches, sbj.Matches),
+				}) {
+					return
+				}
 			}
 		}
 	}()
-	go func() {
-		wg.Wait()
-		close(theseResults)
-	}()
 
-	newResults := make(chan *Combination)
-	tResults := make(chan *Combination)
+	results := first
+	for _, dependency := range dependencies[2:] {
+		results = mergeDependency(ctx, options, results, dependency)
+	}
+	return results
+}
 
+// mergeDependency combines every combination of results with the boxes of a dependency
+func mergeDependency(ctx context.Context, options combinerOptions, results chan *Combination, dependency []*SearchBox) chan *Combination {
+	resultChan := make(chan *Combination, options.bufferSize)
 	go func() {
-		count := 0
-		defer close(tResults)
-		defer close(newResults)
-		for tr := range theseResults {
-			if count%10000 == 0 {
-				log.Debugf("Ran %d", count)
+		defer close(resultChan)
+		for {
+			r, ok := receiveCombination(ctx, results)
+			if !ok {
+				return
 			}
-			count++
-			tResults <- tr
-			for pr := range results {
-				types := map[string]*SearchBox{}
-				for k, v := range tr.Types {
-					types[k] = v
+
+			for _, d := range dependency {
+				matches := MergeArr(r.Matches, d.Matches)
+				if len(matches) == 0 {
+					continue
 				}
-				for k, v := range pr.Types {
-					types[k] = v
+
+				ts := map[string]*SearchBox{
+					d.Type: d,
+				}
+				for _, t := range r.Types {
+					ts[t.Type] = t
 				}
-				newResults <- &Combination{
-					Types:   types,
-					Matches: MergeArr(tr.Matches, pr.Matches),
+
+				if !sendCombination(ctx, resultChan, &Combination{
+					Types:   ts,
+					Matches: matches,
+				}) {
+					return
 				}
 			}
 		}
 	}()
-	if len(newResults) == 0 {
-		return DependencyMerge(tResults, dependencies[2:]...)
+	return resultChan
+}
+
+// forwardCombinations sends every combination received from from to to, until
+// from is closed or ctx is cancelled
+func forwardCombinations(ctx context.Context, from <-chan *Combination, to chan<- *Combination) {
+	for {
+		c, ok := receiveCombination(ctx, from)
+		if !ok || !sendCombination(ctx, to, c) {
+			return
+		}
 	}
+}
 
-	return DependencyMerge(newResults, dependencies[2:]...)
+// sendCombination sends c unless ctx is cancelled first, reporting whether it was sent
+func sendCombination(ctx context.Context, ch chan<- *Combination, c *Combination) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case ch <- c:
+		return true
+	}
+}
+
+// receiveCombination receives the next combination, reporting false when ch is
+// closed or ctx is cancelled
+func receiveCombination(ctx context.Context, ch <-chan *Combination) (*Combination, bool) {
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case c, ok := <-ch:
+		return c, ok
+	}
 }
@@ -0,0 +1,123 @@
+package combind_test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func boxesOf(typ string, n int) []*combind.SearchBox {
+	boxes := []*combind.SearchBox{}
+	for i := 0; i < n; i++ {
+		code := fmt.Sprintf("%s%d", typ, i)
+		boxes = append(boxes, &combind.SearchBox{
+			Key:     code,
+			Type:    typ,
+			Matches: []combind.Key{{typ: code}},
+		})
+	}
+	return boxes
+}
+
+func TestDependencyMergeProducesEveryCombination(t *testing.T) {
+	ctx := context.Background()
+	count := 0
+	for c := range combind.DependencyMergeContext(ctx, nil, boxesOf("a", 3), boxesOf("b", 4), boxesOf("c", 5)) {
+		assert.Len(t, c.Types, 3)
+		assert.Len(t, c.Matches, 1)
+		count++
+	}
+	assert.Equal(t, 60, count)
+}
+
+func TestDependencyMergeCombinesEveryDependency(t *testing.T) {
+	ctx := context.Background()
+
+	single := 0
+	for c := range combind.DependencyMergeContext(ctx, nil, boxesOf("a", 3)) {
+		assert.Len(t, c.Types, 1)
+		single++
+	}
+	assert.Equal(t, 3, single)
+
+	count := 0
+	for c := range combind.DependencyMergeContext(ctx, nil, boxesOf("a", 2), boxesOf("b", 3), boxesOf("c", 4), boxesOf("d", 5)) {
+		assert.Len(t, c.Types, 4)
+		assert.Len(t, c.Matches, 1)
+		count++
+	}
+	assert.Equal(t, 120, count)
+}
+
+func TestDependencyMergeCombinesSeed(t *testing.T) {
+	seed := make(chan *combind.Combination, 2)
+	for _, sb := range boxesOf("a", 2) {
+		seed <- &combind.Combination{Types: map[string]*combind.SearchBox{sb.Type: sb}, Matches: sb.Matches}
+	}
+	close(seed)
+
+	count := 0
+	for c := range combind.DependencyMerge(seed, boxesOf("b", 3), boxesOf("c", 4)) {
+		assert.Len(t, c.Types, 3)
+		count++
+	}
+	assert.Equal(t, 24, count)
+
+	empty := make(chan *combind.Combination)
+	close(empty)
+	count = 0
+	for range combind.DependencyMerge(empty, boxesOf("b", 3), boxesOf("c", 4)) {
+		count++
+	}
+	assert.Equal(t, 12, count)
+}
+
+func TestDependencyMergeStopsOnCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := combind.DependencyMergeContext(ctx, nil, boxesOf("a", 100), boxesOf("b", 100), boxesOf("c", 100))
+	<-ch
+	cancel()
+
+	assertNoLeakedGoroutines(t, before)
+}
+
+func TestVirtualComponentBuildReturnsOnCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	storage := combind.NewMemoryComponentStorage()
+	for i := 0; i < 200; i++ {
+		_ = storage.Save(ctx,
+			&combind.BackendComponent{Code: fmt.Sprintf("a%d", i), Type: "a"},
+			&combind.BackendComponent{Code: fmt.Sprintf("b%d", i), Type: "b"},
+		)
+	}
+
+	vc := combind.NewVirtualComponent("ab", nil, combind.WithContextCombiner(combind.JoinCombiner(combind.WithCombinerBufferSize(8))),
+		combind.WithDependency(combind.NewRoot("a", storage), combind.NewRoot("b", storage)),
+		combind.WithWorkers(2),
+		combind.WithRule(func(c *combind.Combination) (*combind.SearchBox, bool) {
+			cancel()
+			return nil, false
+		}),
+	)
+
+	_, err := vc.Build(ctx, true)
+	assert.Equal(t, context.Canceled, err)
+
+	assertNoLeakedGoroutines(t, before)
+}
+
+func assertNoLeakedGoroutines(t *testing.T, before int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
@@ -0,0 +1,206 @@
+package combind
+
+import (
+	"context"
+	"sort"
+)
+
+// SearchBoxDiff holds the created, updated and deleted SearchBoxes of one component type
+type SearchBoxDiff struct {
+	Created []*SearchBox `json:"created"`
+	Updated []*SearchBox `json:"updated"`
+	Deleted []*SearchBox `json:"deleted"`
+}
+
+// BuildDiff holds a SearchBoxDiff per component type
+type BuildDiff map[string]*SearchBoxDiff
+
+// Empty reports whether the diff contains no changes at all
+func (d BuildDiff) Empty() bool {
+	for _, td := range d {
+		if len(td.Created)+len(td.Updated)+len(td.Deleted) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// diffSearchBoxes compares the existing boxes of a type with a new build, keyed on SearchBox.Key
+func diffSearchBoxes(existing []*SearchBox, built []*SearchBox) *SearchBoxDiff {
+	diff := &SearchBoxDiff{
+		Created: []*SearchBox{},
+		Updated: []*SearchBox{},
+		Deleted: []*SearchBox{},
+	}
+
+	builtIndex := map[string]*SearchBox{}
+	existingIndex := map[string]*SearchBox{}
+
+	for _, builtBox := range built {
+		builtIndex[builtBox.Key] = builtBox
+	}
+
+	for _, existingBox := range existing {
+		existingIndex[existingBox.Key] = existingBox
+	}
+
+	for _, k := range sortedBoxKeys(builtIndex) {
+		if existingBox, ok := existingIndex[k]; !ok {
+			diff.Created = append(diff.Created, builtIndex[k])
+		} else if !sameSearchBox(existingBox, builtIndex[k]) {
+			diff.Updated = append(diff.Updated, builtIndex[k])
+		}
+	}
+
+	for _, k := range sortedBoxKeys(existingIndex) {
+		if _, ok := builtIndex[k]; !ok {
+			diff.Deleted = append(diff.Deleted, existingIndex[k])
+		}
+	}
+
+	return diff
+}
+
+// groupSearchBoxes folds per-match documents back into SearchBoxes with all their Matches
+func groupSearchBoxes(documents []SearchBox) []*SearchBox {
+	index := map[string]*SearchBox{}
+	result := []*SearchBox{}
+
+	for _, d := range documents {
+		sb, ok := index[d.Key]
+		if !ok {
+			sb = groupedSearchBox(d)
+			index[d.Key] = sb
+			result = append(result, sb)
+		}
+		addGroupedMatch(sb, d)
+	}
+
+	return result
+}
+
+// groupedSearchBox creates the SearchBox of a stored document, without matches
+func groupedSearchBox(d SearchBox) *SearchBox {
+	return &SearchBox{
+		Key:         d.Key,
+		Type:        d.Type,
+		Props:       d.Props,
+		HashVersion: d.HashVersion,
+		Matches:     []Key{},
+	}
+}
+
+// addGroupedMatch adds the match of a stored document, and its provenance, to its SearchBox
+func addGroupedMatch(sb *SearchBox, d SearchBox) {
+	if d.Match == nil {
+		return
+	}
+	sb.Matches = append(sb.Matches, d.Match)
+	if len(d.MatchProvenance) > 0 {
+		if sb.Provenance == nil {
+			sb.Provenance = map[string][]Provenance{}
+		}
+		sb.Provenance[Hash(d.Match)] = d.MatchProvenance
+	}
+}
+
+// searchBoxGrouper folds documents sorted on key into whole SearchBoxes, one at a time
+type searchBoxGrouper struct {
+	current *SearchBox
+	fn      func(*SearchBox) error
+}
+
+func (g *searchBoxGrouper) add(d SearchBox) error {
+	if g.current != nil && g.current.Key == d.Key {
+		addGroupedMatch(g.current, d)
+		return nil
+	}
+	if err := g.flush(); err != nil {
+		return err
+	}
+	g.current = groupedSearchBox(d)
+	addGroupedMatch(g.current, d)
+	return nil
+}
+
+// flush passes on the box being grouped, if any
+func (g *searchBoxGrouper) flush() error {
+	if g.current == nil {
+		return nil
+	}
+	sb := g.current
+	g.current = nil
+	return g.fn(sb)
+}
+
+// collectSearchBoxes reads every box of a type with a FindEach
+func collectSearchBoxes(ctx context.Context, boxType string, findEach func(context.Context, string, func(*SearchBox) error) error) ([]SearchBox, error) {
+	results := []SearchBox{}
+	err := findEach(ctx, boxType, func(sb *SearchBox) error {
+		results = append(results, *sb)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// searchBoxPointers returns pointers to copies of the boxes
+func searchBoxPointers(boxes []SearchBox) []*SearchBox {
+	result := make([]*SearchBox, 0, len(boxes))
+	for i := range boxes {
+		sb := boxes[i]
+		result = append(result, &sb)
+	}
+	return result
+}
+
+// sameSearchBox compares boxes the way they are stored, i.e props by their
+// JSON representation and matches regardless of order
+func sameSearchBox(a *SearchBox, b *SearchBox) bool {
+	if a.Type != b.Type || a.Key != b.Key {
+		return false
+	}
+
+	if !sameProps(a.Props, b.Props) {
+		return false
+	}
+
+	ha := map[string]bool{}
+	for _, m := range a.Matches {
+		ha[Hash(m)] = true
+	}
+	hb := map[string]bool{}
+	for _, m := range b.Matches {
+		hb[Hash(m)] = true
+	}
+	if len(ha) != len(hb) {
+		return false
+	}
+	for h := range ha {
+		if !hb[h] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedDiffTypes(diff BuildDiff) []string {
+	types := []string{}
+	for typ := range diff {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func sortedBoxKeys(index map[string]*SearchBox) []string {
+	keys := []string{}
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
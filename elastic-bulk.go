@@ -0,0 +1,193 @@
+package combind
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// BulkOptions configures the bulk processor the Elastic storages write with,
+// zero values keep the defaults of the client
+type BulkOptions struct {
+	// Workers is the number of concurrent bulk requests
+	Workers int
+	// Actions is the number of documents per bulk request
+	Actions int
+	// Size is the size in bytes of a bulk request
+	Size int
+	// FlushInterval commits pending documents periodically
+	FlushInterval time.Duration
+	// Backoff retries failed bulk requests
+	Backoff elastic.Backoff
+}
+
+// WithBulkOptions configures the bulk processor of Save and Apply
+func WithBulkOptions(options BulkOptions) ElasticSearchBoxStorageConfiguration {
+	return func(s *elasticSearchBoxStorage) {
+		s.bulkOptions = options
+	}
+}
+
+// ElasticComponentStorageConfiguration configures the Elastic ComponentStorage
+type ElasticComponentStorageConfiguration func(*elasticComponentStorage)
+
+// WithComponentBulkOptions configures the bulk processor of Save and Delete
+func WithComponentBulkOptions(options BulkOptions) ElasticComponentStorageConfiguration {
+	return func(s *elasticComponentStorage) {
+		s.bulkOptions = options
+	}
+}
+
+// BulkFailure is a document Elasticsearch did not write
+type BulkFailure struct {
+	ID     string `json:"id"`
+	Index  string `json:"index"`
+	Status int    `json:"status"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// BulkError lists the documents that failed in a bulk write
+type BulkError struct {
+	Failures []BulkFailure
+}
+
+// maxReportedFailures limits the failures listed by BulkError.Error
+const maxReportedFailures = 10
+
+func (e *BulkError) Error() string {
+	failures := []string{}
+	for i, f := range e.Failures {
+		if i == maxReportedFailures {
+			failures = append(failures, fmt.Sprintf("and %d more", len(e.Failures)-i))
+			break
+		}
+		failures = append(failures, fmt.Sprintf("%s (%s: %s)", f.ID, f.Type, f.Reason))
+	}
+	return fmt.Sprintf("%d documents failed: %s", len(e.Failures), strings.Join(failures, ", "))
+}
+
+// bulkIndexer is a bulk processor collecting the failed documents
+type bulkIndexer struct {
+	processor *elastic.BulkProcessor
+	mu        sync.Mutex
+	failures  []BulkFailure
+}
+
+func newBulkIndexer(ctx context.Context, client *elastic.Client, options BulkOptions) (*bulkIndexer, error) {
+	b := &bulkIndexer{}
+
+	service := elastic.NewBulkProcessorService(client).Stats(true).After(b.after)
+	if options.Workers > 0 {
+		service = service.Workers(options.Workers)
+	}
+	if options.Actions > 0 {
+		service = service.BulkActions(options.Actions)
+	}
+	if options.Size > 0 {
+		service = service.BulkSize(options.Size)
+	}
+	if options.FlushInterval > 0 {
+		service = service.FlushInterval(options.FlushInterval)
+	}
+	if options.Backoff != nil {
+		service = service.Backoff(options.Backoff)
+	}
+
+	processor, err := service.Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create bulk processor: %w", err)
+	}
+	b.processor = processor
+	return b, nil
+}
+
+func (b *bulkIndexer) add(request elastic.BulkableRequest) {
+	b.processor.Add(request)
+}
+
+// flush commits the pending documents and returns a *BulkError if any document failed
+func (b *bulkIndexer) flush() error {
+	if err := b.processor.Flush(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.failures) > 0 {
+		return &BulkError{Failures: append([]BulkFailure{}, b.failures...)}
+	}
+	return nil
+}
+
+// indexed is the number of documents written
+func (b *bulkIndexer) indexed() int64 {
+	return b.processor.Stats().Indexed
+}
+
+func (b *bulkIndexer) close() error {
+	return b.processor.Close()
+}
+
+func (b *bulkIndexer) after(executionID int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil && (response == nil || len(response.Items) == 0) {
+		for _, r := range requests {
+			f := bulkRequestFailure(r)
+			f.Reason = err.Error()
+			b.failures = append(b.failures, f)
+		}
+		return
+	}
+	if response == nil {
+		return
+	}
+
+	for _, item := range response.Failed() {
+		// deleting a missing document is not a failure
+		if item.Result == "not_found" {
+			continue
+		}
+		f := BulkFailure{
+			ID:     item.Id,
+			Index:  item.Index,
+			Status: item.Status,
+		}
+		if item.Error != nil {
+			f.Type = item.Error.Type
+			f.Reason = item.Error.Reason
+		}
+		b.failures = append(b.failures, f)
+	}
+}
+
+// bulkRequestFailure reads the index and id of a request from its action line
+func bulkRequestFailure(r elastic.BulkableRequest) BulkFailure {
+	f := BulkFailure{
+		Type: "request_failed",
+	}
+	source, err := r.Source()
+	if err != nil || len(source) == 0 {
+		return f
+	}
+
+	action := map[string]struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	}{}
+	if err := json.Unmarshal([]byte(source[0]), &action); err != nil {
+		return f
+	}
+	for _, meta := range action {
+		f.ID = meta.ID
+		f.Index = meta.Index
+	}
+	return f
+}
@@ -0,0 +1,569 @@
+package combind_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic/v7"
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeElastic implements the part of the Elasticsearch API used by the storages
+type fakeElastic struct {
+	mu      sync.Mutex
+	indices map[string]*fakeIndex
+	aliases map[string][]string
+	clock   int64
+	// reject returns why a document is rejected, if it is
+	reject func(doc map[string]interface{}) string
+	// autoCreate creates missing indexes on bulk writes
+	autoCreate bool
+	// failDelete fails every index delete
+	failDelete bool
+	pits       int
+	openPits   map[string]string
+	// deleteByQueries counts the delete by query requests
+	deleteByQueries int
+}
+
+type fakeIndex struct {
+	body      map[string]interface{}
+	documents map[string]map[string]interface{}
+	created   int64
+}
+
+func newFakeElastic(t *testing.T) (*fakeElastic, *elastic.Client) {
+	f := &fakeElastic{
+		indices:  map[string]*fakeIndex{},
+		aliases:  map[string][]string{},
+		openPits: map[string]string{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(server.URL),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+	)
+	assert.NoError(t, err)
+
+	return f, client
+}
+
+func (f *fakeElastic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPost && path == "_bulk":
+		f.bulk(w, r)
+	case r.Method == http.MethodGet && path == "_cat/aliases":
+		rows := []map[string]string{}
+		for alias, indices := range f.aliases {
+			for _, index := range indices {
+				rows = append(rows, map[string]string{"alias": alias, "index": index})
+			}
+		}
+		respond(w, http.StatusOK, rows)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "_cat/indices/"):
+		pattern := strings.TrimSuffix(strings.TrimPrefix(path, "_cat/indices/"), "*")
+		rows := []map[string]string{}
+		for name, index := range f.indices {
+			if strings.HasPrefix(name, pattern) {
+				rows = append(rows, map[string]string{
+					"index":         name,
+					"docs.count":    strconv.Itoa(len(index.documents)),
+					"creation.date": strconv.FormatInt(index.created, 10),
+				})
+			}
+		}
+		respond(w, http.StatusOK, rows)
+	case strings.HasSuffix(path, "/_refresh"):
+		respond(w, http.StatusOK, map[string]interface{}{"_shards": map[string]int{"total": 1, "successful": 1}})
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/_pit"):
+		name := strings.TrimSuffix(path, "/_pit")
+		if _, ok := f.indices[f.resolve(name)]; !ok {
+			respond(w, http.StatusNotFound, map[string]interface{}{
+				"error": map[string]interface{}{"type": "index_not_found_exception", "reason": "no such index [" + name + "]"},
+			})
+			return
+		}
+		f.pits++
+		id := "pit-" + strconv.Itoa(f.pits)
+		f.openPits[id] = name
+		respond(w, http.StatusOK, map[string]interface{}{"id": id})
+	case r.Method == http.MethodDelete && path == "_pit":
+		body := map[string]string{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		delete(f.openPits, body["id"])
+		respond(w, http.StatusOK, map[string]interface{}{"succeeded": true, "num_freed": 1})
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/_delete_by_query"):
+		f.deleteByQuery(w, r, strings.TrimSuffix(path, "/_delete_by_query"))
+	case path == "_search":
+		f.search(w, r, "")
+	case strings.HasSuffix(path, "/_search"):
+		f.search(w, r, strings.TrimSuffix(path, "/_search"))
+	case r.Method == http.MethodPost && path == "_aliases":
+		f.updateAliases(w, r)
+	case r.Method == http.MethodHead:
+		if _, ok := f.indices[path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPut:
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			body = nil
+		}
+		f.clock += 1000
+		f.indices[path] = &fakeIndex{body: body, documents: map[string]map[string]interface{}{}, created: f.clock}
+		respond(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "index": path})
+	case r.Method == http.MethodDelete && f.failDelete:
+		respond(w, http.StatusForbidden, map[string]interface{}{
+			"error": map[string]interface{}{"type": "cluster_block_exception", "reason": "index [" + path + "] blocked"},
+		})
+	case r.Method == http.MethodDelete:
+		for _, index := range strings.Split(path, ",") {
+			delete(f.indices, index)
+			for alias, indices := range f.aliases {
+				remaining := []string{}
+				for _, i := range indices {
+					if i != index {
+						remaining = append(remaining, i)
+					}
+				}
+				f.aliases[alias] = remaining
+			}
+		}
+		respond(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+	default:
+		respond(w, http.StatusBadRequest, map[string]interface{}{
+			"error": map[string]interface{}{"type": "unsupported", "reason": r.Method + " " + r.URL.Path},
+		})
+	}
+}
+
+func (f *fakeElastic) bulk(w http.ResponseWriter, r *http.Request) {
+	items := []interface{}{}
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		action := map[string]map[string]string{}
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			break
+		}
+
+		if meta, ok := action["delete"]; ok {
+			index := f.resolve(meta["_index"])
+			result := map[string]interface{}{"_index": index, "_id": meta["_id"], "status": 200, "result": "deleted"}
+			if idx, ok := f.indices[index]; !ok || idx.documents[meta["_id"]] == nil {
+				result["status"] = 404
+				result["result"] = "not_found"
+			} else {
+				delete(idx.documents, meta["_id"])
+			}
+			items = append(items, map[string]interface{}{"delete": result})
+			continue
+		}
+
+		if !scanner.Scan() {
+			break
+		}
+		meta := action["index"]
+		doc := map[string]interface{}{}
+		_ = json.Unmarshal(scanner.Bytes(), &doc)
+
+		index := f.resolve(meta["_index"])
+		idx, ok := f.indices[index]
+		switch {
+		case !ok && f.autoCreate:
+			idx = &fakeIndex{documents: map[string]map[string]interface{}{}}
+			f.indices[index] = idx
+		case !ok:
+			items = append(items, map[string]interface{}{
+				"index": map[string]interface{}{"_index": index, "_id": meta["_id"], "status": 404,
+					"error": map[string]interface{}{"type": "index_not_found_exception", "reason": "no such index [" + index + "]"}},
+			})
+			continue
+		}
+
+		if f.reject != nil {
+			if reason := f.reject(doc); reason != "" {
+				items = append(items, map[string]interface{}{
+					"index": map[string]interface{}{"_index": index, "_id": meta["_id"], "status": 400,
+						"error": map[string]interface{}{"type": "mapper_parsing_exception", "reason": reason}},
+				})
+				continue
+			}
+		}
+
+		idx.documents[meta["_id"]] = doc
+		items = append(items, map[string]interface{}{
+			"index": map[string]interface{}{"_index": index, "_id": meta["_id"], "status": 201, "result": "created"},
+		})
+	}
+	respond(w, http.StatusOK, map[string]interface{}{"took": 1, "errors": false, "items": items})
+}
+
+func (f *fakeElastic) deleteByQuery(w http.ResponseWriter, r *http.Request, name string) {
+	body := map[string]interface{}{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	f.deleteByQueries++
+	deleted := 0
+	for _, index := range strings.Split(name, ",") {
+		idx, ok := f.indices[f.resolve(index)]
+		if !ok {
+			respond(w, http.StatusNotFound, map[string]interface{}{
+				"error": map[string]interface{}{"type": "index_not_found_exception", "reason": "no such index [" + index + "]"},
+			})
+			return
+		}
+		for id, d := range idx.documents {
+			if fakeMatches(id, d, body["query"]) {
+				delete(idx.documents, id)
+				deleted++
+			}
+		}
+	}
+	respond(w, http.StatusOK, map[string]interface{}{"took": 1, "deleted": deleted, "total": deleted})
+}
+
+// search supports term, terms, ids and bool queries, sorting on fields, size,
+// search_after, points in time and the type aggregation used by the publish gates
+func (f *fakeElastic) search(w http.ResponseWriter, r *http.Request, name string) {
+	body := map[string]interface{}{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	pit, _ := body["pit"].(map[string]interface{})
+	if pit != nil {
+		id, _ := pit["id"].(string)
+		index, ok := f.openPits[id]
+		if !ok {
+			respond(w, http.StatusNotFound, map[string]interface{}{
+				"error": map[string]interface{}{"type": "search_context_missing_exception", "reason": "no search context found for id [" + id + "]"},
+			})
+			return
+		}
+		name = index
+	}
+
+	index, ok := f.indices[f.resolve(name)]
+	if !ok {
+		respond(w, http.StatusNotFound, map[string]interface{}{
+			"error": map[string]interface{}{"type": "index_not_found_exception", "reason": "no such index [" + name + "]"},
+		})
+		return
+	}
+
+	hits := []fakeHit{}
+	for id, d := range index.documents {
+		if query, ok := body["query"]; !ok || fakeMatches(id, d, query) {
+			hits = append(hits, fakeHit{id: id, doc: d})
+		}
+	}
+	fields := fakeSortFields(body["sort"])
+	sort.Slice(hits, func(i, j int) bool {
+		return fakeCompare(hits[i], hits[j], fields) < 0
+	})
+	total := len(hits)
+
+	if after, ok := body["search_after"].([]interface{}); ok {
+		for len(hits) > 0 && fakeCompareValues(fakeSortValues(hits[0], fields), after) <= 0 {
+			hits = hits[1:]
+		}
+	}
+
+	size := 10
+	if v, ok := body["size"].(float64); ok {
+		size = int(v)
+	}
+
+	response := map[string]interface{}{
+		"took": 1,
+	}
+	if _, ok := body["aggregations"]; ok {
+		response["aggregations"] = fakeTypeAggregation(index)
+	}
+	if pit != nil {
+		response["pit_id"] = pit["id"]
+	}
+	if len(hits) > size {
+		hits = hits[:size]
+	}
+
+	response["hits"] = fakeHits(total, hits, fields)
+	respond(w, http.StatusOK, response)
+}
+
+type fakeHit struct {
+	id  string
+	doc map[string]interface{}
+}
+
+type fakeSortField struct {
+	field string
+	desc  bool
+}
+
+func fakeHits(total int, hits []fakeHit, fields []fakeSortField) map[string]interface{} {
+	result := []interface{}{}
+	for _, h := range hits {
+		hit := map[string]interface{}{"_id": h.id, "_source": h.doc}
+		if len(fields) > 0 {
+			hit["sort"] = fakeSortValues(h, fields)
+		}
+		result = append(result, hit)
+	}
+	return map[string]interface{}{
+		"total": map[string]interface{}{"value": total, "relation": "eq"},
+		"hits":  result,
+	}
+}
+
+func fakeTypeAggregation(index *fakeIndex) map[string]interface{} {
+	counts := map[string]int{}
+	notMapped := map[string]int{}
+	for _, d := range index.documents {
+		typ := d["type"].(string)
+		counts[typ]++
+		if d["key"] == combind.NotMappedKey {
+			notMapped[typ]++
+		}
+	}
+	buckets := []interface{}{}
+	for typ, n := range counts {
+		buckets = append(buckets, map[string]interface{}{
+			"key":        typ,
+			"doc_count":  n,
+			"not_mapped": map[string]interface{}{"doc_count": notMapped[typ]},
+		})
+	}
+	return map[string]interface{}{
+		"types": map[string]interface{}{"buckets": buckets},
+	}
+}
+
+// fakeField reads a field like props.name.keyword from a document
+func fakeField(doc map[string]interface{}, field string) interface{} {
+	var v interface{} = doc
+	for _, part := range strings.Split(strings.TrimSuffix(field, ".keyword"), ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+func fakeMatches(id string, doc map[string]interface{}, query interface{}) bool {
+	q, ok := query.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	if term, ok := q["term"].(map[string]interface{}); ok {
+		for field, value := range term {
+			if m, ok := value.(map[string]interface{}); ok {
+				value = m["value"]
+			}
+			if fmt.Sprint(fakeField(doc, field)) != fmt.Sprint(value) {
+				return false
+			}
+		}
+		return true
+	}
+	if terms, ok := q["terms"].(map[string]interface{}); ok {
+		for field, values := range terms {
+			found := false
+			for _, v := range fakeClauses(values) {
+				if fmt.Sprint(fakeField(doc, field)) == fmt.Sprint(v) {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	if ids, ok := q["ids"].(map[string]interface{}); ok {
+		values, _ := ids["values"].([]interface{})
+		for _, v := range values {
+			if v == id {
+				return true
+			}
+		}
+		return false
+	}
+	if b, ok := q["bool"].(map[string]interface{}); ok {
+		for _, clause := range fakeClauses(b["must"]) {
+			if !fakeMatches(id, doc, clause) {
+				return false
+			}
+		}
+		for _, clause := range fakeClauses(b["filter"]) {
+			if !fakeMatches(id, doc, clause) {
+				return false
+			}
+		}
+		for _, clause := range fakeClauses(b["must_not"]) {
+			if fakeMatches(id, doc, clause) {
+				return false
+			}
+		}
+		if should := fakeClauses(b["should"]); len(should) > 0 {
+			for _, clause := range should {
+				if fakeMatches(id, doc, clause) {
+					return true
+				}
+			}
+			return false
+		}
+		return true
+	}
+	return true
+}
+
+func fakeClauses(clauses interface{}) []interface{} {
+	switch c := clauses.(type) {
+	case []interface{}:
+		return c
+	case map[string]interface{}:
+		return []interface{}{c}
+	default:
+		return nil
+	}
+}
+
+func fakeSortFields(sorts interface{}) []fakeSortField {
+	fields := []fakeSortField{}
+	for _, s := range fakeClauses(sorts) {
+		switch v := s.(type) {
+		case string:
+			fields = append(fields, fakeSortField{field: v})
+		case map[string]interface{}:
+			for field, order := range v {
+				desc := false
+				if o, ok := order.(map[string]interface{}); ok {
+					desc = o["order"] == "desc"
+				} else {
+					desc = order == "desc"
+				}
+				fields = append(fields, fakeSortField{field: field, desc: desc})
+			}
+		}
+	}
+	return fields
+}
+
+func fakeSortValues(h fakeHit, fields []fakeSortField) []interface{} {
+	values := []interface{}{}
+	for _, f := range fields {
+		if f.field == "_id" || f.field == "_shard_doc" {
+			values = append(values, h.id)
+		} else {
+			values = append(values, fmt.Sprint(fakeField(h.doc, f.field)))
+		}
+	}
+	return values
+}
+
+func fakeCompare(a fakeHit, b fakeHit, fields []fakeSortField) int {
+	if len(fields) == 0 {
+		return strings.Compare(a.id, b.id)
+	}
+	va, vb := fakeSortValues(a, fields), fakeSortValues(b, fields)
+	for i, f := range fields {
+		c := strings.Compare(fmt.Sprint(va[i]), fmt.Sprint(vb[i]))
+		if f.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func fakeCompareValues(a []interface{}, b []interface{}) int {
+	for i := range a {
+		if i >= len(b) {
+			return 1
+		}
+		if c := strings.Compare(fmt.Sprint(a[i]), fmt.Sprint(b[i])); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (f *fakeElastic) updateAliases(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Actions []map[string]map[string]string `json:"actions"`
+	}{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	for _, action := range body.Actions {
+		if a, ok := action["remove"]; ok {
+			indices := []string{}
+			for _, index := range f.aliases[a["alias"]] {
+				if index != a["index"] {
+					indices = append(indices, index)
+				}
+			}
+			f.aliases[a["alias"]] = indices
+		}
+		if a, ok := action["add"]; ok {
+			f.aliases[a["alias"]] = append(f.aliases[a["alias"]], a["index"])
+		}
+	}
+	respond(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+// resolve returns the index behind an alias, or the index itself
+func (f *fakeElastic) resolve(name string) string {
+	if indices := f.aliases[name]; len(indices) > 0 {
+		return indices[0]
+	}
+	return name
+}
+
+func (f *fakeElastic) indexNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := []string{}
+	for name := range f.indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openPointsInTime is the number of points in time not closed yet
+func (f *fakeElastic) openPointsInTime() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.openPits)
+}
+
+func (f *fakeElastic) index(name string) *fakeIndex {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.indices[f.resolve(name)]
+}
+
+func respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
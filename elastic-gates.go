@@ -0,0 +1,180 @@
+package combind
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NotMappedKey is the key of the box the default no mapping rule puts the unmatched combinations in
+const NotMappedKey = "not-mapped"
+
+// IndexStats counts the documents of an index, per type
+type IndexStats struct {
+	Index string
+	// Documents is the number of match documents per type
+	Documents map[string]int64
+	// NotMapped is the number of match documents per type with the NotMappedKey
+	NotMapped map[string]int64
+}
+
+// Total is the number of documents of every type
+func (s *IndexStats) Total() int64 {
+	total := int64(0)
+	for _, n := range s.Documents {
+		total += n
+	}
+	return total
+}
+
+// PublishGate checks a new index before Save rolls the alias to it. Previous
+// holds the stats of the index behind the alias, nil on the first Save
+type PublishGate func(ctx context.Context, current *IndexStats, previous *IndexStats) error
+
+// PublishGateError is returned by Save when gates failed, the alias is left
+// where it was and the new index is deleted
+type PublishGateError struct {
+	Index    string
+	Failures []error
+}
+
+func (e *PublishGateError) Error() string {
+	failures := []string{}
+	for _, f := range e.Failures {
+		failures = append(failures, f.Error())
+	}
+	return fmt.Sprintf("index %s failed publish gates: %s", e.Index, strings.Join(failures, "; "))
+}
+
+// WithPublishGates adds gates Save runs against a new index before rolling the
+// alias. Every gate runs, all failures are reported
+func WithPublishGates(gates ...PublishGate) ElasticSearchBoxStorageConfiguration {
+	return func(s *elasticSearchBoxStorage) {
+		s.gates = append(s.gates, gates...)
+	}
+}
+
+// MinDocuments fails when the index has fewer than min documents of the type
+func MinDocuments(boxType string, min int64) PublishGate {
+	return func(ctx context.Context, current *IndexStats, previous *IndexStats) error {
+		if n := current.Documents[boxType]; n < min {
+			return fmt.Errorf("%d documents of type %s, expected at least %d", n, boxType, min)
+		}
+		return nil
+	}
+}
+
+// MaxNotMappedShare fails when more than share, between 0 and 1, of the
+// documents of a virtual component type are not mapped
+func MaxNotMappedShare(boxType string, share float64) PublishGate {
+	return func(ctx context.Context, current *IndexStats, previous *IndexStats) error {
+		total := current.Documents[boxType]
+		if total == 0 {
+			return nil
+		}
+		if s := float64(current.NotMapped[boxType]) / float64(total); s > share {
+			return fmt.Errorf("%.1f%% of type %s is not mapped, expected at most %.1f%%", s*100, boxType, share*100)
+		}
+		return nil
+	}
+}
+
+// MaxDrop fails when the index has more than share, between 0 and 1, fewer
+// documents than the previous index
+func MaxDrop(share float64) PublishGate {
+	return func(ctx context.Context, current *IndexStats, previous *IndexStats) error {
+		if previous == nil || previous.Total() == 0 {
+			return nil
+		}
+		before, after := previous.Total(), current.Total()
+		if drop := float64(before-after) / float64(before); drop > share {
+			return fmt.Errorf("%d documents, %.1f%% fewer than the previous %d, expected at most %.1f%%", after, drop*100, before, share*100)
+		}
+		return nil
+	}
+}
+
+// checkGates runs the gates against a new index
+func (s *elasticSearchBoxStorage) checkGates(ctx context.Context, index string) error {
+	if len(s.gates) == 0 {
+		return nil
+	}
+
+	if _, err := s.client.Refresh(index).Do(ctx); err != nil {
+		return err
+	}
+	current, err := s.indexStats(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	var previous *IndexStats
+	aliased, err := s.aliasedIndexes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(aliased) > 0 {
+		if previous, err = s.indexStats(ctx, s.searchIndex); err != nil {
+			return err
+		}
+	}
+
+	failures := []error{}
+	for _, gate := range s.gates {
+		if err := gate(ctx, current, previous); err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if len(failures) > 0 {
+		return &PublishGateError{Index: index, Failures: failures}
+	}
+	return nil
+}
+
+func (s *elasticSearchBoxStorage) indexStats(ctx context.Context, index string) (*IndexStats, error) {
+	types := elastic.NewTermsAggregation().Field("type.keyword").Size(10000).
+		SubAggregation("not_mapped", elastic.NewFilterAggregation().Filter(elastic.NewTermQuery("key.keyword", NotMappedKey)))
+
+	r, err := s.client.Search(index).Size(0).Aggregation("types", types).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &IndexStats{
+		Index:     index,
+		Documents: map[string]int64{},
+		NotMapped: map[string]int64{},
+	}
+	buckets, ok := r.Aggregations.Terms("types")
+	if !ok {
+		return stats, nil
+	}
+	for _, b := range buckets.Buckets {
+		typ := fmt.Sprint(b.Key)
+		stats.Documents[typ] = b.DocCount
+		if nm, ok := b.Filter("not_mapped"); ok {
+			stats.NotMapped[typ] = nm.DocCount
+		}
+	}
+
+	return stats, nil
+}
+
+// discardTimeout bounds cleaning up a new index that won't be published
+const discardTimeout = 30 * time.Second
+
+// discard deletes a new index that won't be published. It doesn't use the
+// context of the Save, which may be why the index is discarded. A failed
+// delete is logged, the caller returns why the index is not published
+func (s *elasticSearchBoxStorage) discard(index string) {
+	ctx, cancel := context.WithTimeout(context.Background(), discardTimeout)
+	defer cancel()
+	if _, err := s.client.DeleteIndex(index).Do(ctx); err != nil {
+		log.Errorf("Error while deleting new index %s: %s", index, err)
+	}
+}
@@ -0,0 +1,231 @@
+package combind
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SearchBoxHistory is implemented by storages keeping the indexes of earlier
+// builds, e.g the Elastic SearchBoxStorage configured WithRetention
+type SearchBoxHistory interface {
+	// History lists the retained index generations, oldest first
+	History(ctx context.Context) ([]IndexGeneration, error)
+	// Rollback moves the alias back the given number of generations from the active one
+	Rollback(ctx context.Context, steps int) error
+}
+
+// IndexGeneration is an index written by a Save
+type IndexGeneration struct {
+	Index     string    `json:"index"`
+	Created   time.Time `json:"created"`
+	Documents int64     `json:"documents"`
+	Active    bool      `json:"active"`
+}
+
+// WithRetention keeps the last retention indexes, the new one included, when
+// Save rolls the alias. The default 1 deletes every earlier index
+func WithRetention(retention int) ElasticSearchBoxStorageConfiguration {
+	return func(s *elasticSearchBoxStorage) {
+		s.retention = retention
+	}
+}
+
+// History lists the indexes written by Save with the prefix, oldest first
+func (s *elasticSearchBoxStorage) History(ctx context.Context) ([]IndexGeneration, error) {
+	rows, err := s.client.CatIndices().Index(s.indexPrefix+"-*").Columns("index", "docs.count", "creation.date").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := s.aliasedIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	isActive := map[string]bool{}
+	for _, index := range active {
+		isActive[index] = true
+	}
+
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(s.indexPrefix) + `-\d+-[0-9a-f-]{36}$`)
+	generations := []IndexGeneration{}
+	for _, row := range rows {
+		if !pattern.MatchString(row.Index) {
+			continue
+		}
+		generations = append(generations, IndexGeneration{
+			Index:     row.Index,
+			Created:   time.Unix(0, row.CreationDate*int64(time.Millisecond)).UTC(),
+			Documents: int64(row.DocsCount),
+			Active:    isActive[row.Index],
+		})
+	}
+
+	sort.Slice(generations, func(i, j int) bool {
+		if !generations[i].Created.Equal(generations[j].Created) {
+			return generations[i].Created.Before(generations[j].Created)
+		}
+		return generations[i].Index < generations[j].Index
+	})
+
+	return generations, nil
+}
+
+// Rollback moves the alias to the index steps generations before the active one
+func (s *elasticSearchBoxStorage) Rollback(ctx context.Context, steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("rollback needs at least one step, got %d", steps)
+	}
+
+	generations, err := s.History(ctx)
+	if err != nil {
+		return err
+	}
+
+	active := -1
+	for i, g := range generations {
+		if g.Active {
+			active = i
+		}
+	}
+	if active < 0 {
+		return fmt.Errorf("alias %s is not on any retained index", s.searchIndex)
+	}
+	if active-steps < 0 {
+		return fmt.Errorf("cannot roll back %d steps, only %d earlier indexes are retained", steps, active)
+	}
+
+	// every generation after the target was behind the alias before it was rolled back
+	rolledBack := []string{}
+	for _, g := range generations[active-steps+1 : active+1] {
+		rolledBack = append(rolledBack, g.Index)
+	}
+
+	_, err = s.rollAlias(ctx, generations[active-steps].Index, rolledBack...)
+	return err
+}
+
+// rolledBackAlias marks the indexes rolled back from, to be deleted by the next Save
+func (s *elasticSearchBoxStorage) rolledBackAlias() string {
+	return s.searchIndex + "-rolled-back"
+}
+
+// aliasedIndexes returns the indexes currently behind the alias
+func (s *elasticSearchBoxStorage) aliasedIndexes(ctx context.Context) ([]string, error) {
+	return s.indexesOf(ctx, s.searchIndex)
+}
+
+// indexesOf returns the indexes currently behind an alias
+func (s *elasticSearchBoxStorage) indexesOf(ctx context.Context, alias string) ([]string, error) {
+	rows, err := elastic.NewCatAliasesService(s.client).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := []string{}
+	for _, row := range rows {
+		if row.Alias == alias {
+			indexes = append(indexes, row.Index)
+		}
+	}
+	return indexes, nil
+}
+
+// rollAlias atomically moves the alias to the index, marking the rolledBack
+// indexes, and returns the indexes it was on
+func (s *elasticSearchBoxStorage) rollAlias(ctx context.Context, index string, rolledBack ...string) ([]string, error) {
+	previous, err := s.aliasedIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	als := elastic.NewAliasService(s.client)
+	for _, p := range previous {
+		als = als.Remove(p, s.searchIndex)
+	}
+	for _, r := range rolledBack {
+		als = als.Add(r, s.rolledBackAlias())
+	}
+	if _, err := als.Add(index, s.searchIndex).Do(ctx); err != nil {
+		return nil, err
+	}
+	storageObserver(ctx, s.observer).AliasRolled(ctx, s.searchIndex, index, previous)
+
+	return previous, nil
+}
+
+// prune deletes the indexes the alias was on, the indexes rolled back from and
+// the generations beyond the retention. Generations newer than the indexes the
+// alias was on are only deleted when they were rolled back from, others may
+// still be written by a concurrent Save
+func (s *elasticSearchBoxStorage) prune(ctx context.Context, active string, previous []string) {
+	keep := map[string]bool{
+		active: true,
+	}
+
+	rolledBack, err := s.indexesOf(ctx, s.rolledBackAlias())
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+
+	candidates := append(append([]string{}, previous...), rolledBack...)
+	if s.retention > 1 {
+		generations, err := s.History(ctx)
+		if err != nil {
+			log.Warn(err)
+			return
+		}
+
+		wasActive := map[string]bool{}
+		for _, index := range previous {
+			wasActive[index] = true
+		}
+		wasRolledBack := map[string]bool{}
+		for _, index := range rolledBack {
+			wasRolledBack[index] = true
+		}
+		newest := -1
+		for i, g := range generations {
+			if wasActive[g.Index] {
+				newest = i
+			}
+		}
+
+		kept := 1
+		for i := newest; i >= 0; i-- {
+			index := generations[i].Index
+			if index == active || wasRolledBack[index] {
+				continue
+			}
+			if kept < s.retention {
+				keep[index] = true
+				kept++
+			} else {
+				candidates = append(candidates, index)
+			}
+		}
+	}
+
+	idxToDelete := []string{}
+	seen := map[string]bool{}
+	for _, index := range candidates {
+		if !keep[index] && !seen[index] {
+			seen[index] = true
+			idxToDelete = append(idxToDelete, index)
+		}
+	}
+	if len(idxToDelete) == 0 {
+		return
+	}
+
+	if _, err := s.client.DeleteIndex(idxToDelete...).Do(ctx); err != nil {
+		log.Warn(err)
+	}
+}
@@ -0,0 +1,121 @@
+package combind
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pageSize is the number of hits read per search request
+const pageSize = 1000
+
+// pointInTimeKeepAlive is how long a point in time is kept between two pages
+const pointInTimeKeepAlive = "1m"
+
+// pointInTimeCloseTimeout bounds closing a point in time after ctx is done
+const pointInTimeCloseTimeout = 10 * time.Second
+
+type pointInTimeSearchResult struct {
+	elastic.SearchResult
+	PitID string `json:"pit_id"`
+}
+
+// pages calls fn with every page of hits of a query, sorted on the sorters,
+// read with search_after in a point in time of the index. The point in time
+// is closed when pages returns, also when fn fails or ctx is done. Points in
+// time sorted on _shard_doc need Elasticsearch 7.12 or later
+func pages(ctx context.Context, client *elastic.Client, index string, query elastic.Query, fn func([]*elastic.SearchHit) error, sorters ...elastic.Sorter) error {
+	pit, err := openPointInTime(ctx, client, index)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), pointInTimeCloseTimeout)
+		defer cancel()
+		if err := closePointInTime(closeCtx, client, pit); err != nil {
+			log.Warnf("Error while closing point in time of %s: %v", index, err)
+		}
+	}()
+
+	// _shard_doc breaks ties between hits so search_after never skips any
+	sorters = append(sorters, elastic.NewFieldSort("_shard_doc"))
+
+	var after []interface{}
+	for {
+		source := elastic.NewSearchSource().Query(query).Size(pageSize).SortBy(sorters...)
+		if after != nil {
+			source = source.SearchAfter(after...)
+		}
+		body, err := source.Source()
+		if err != nil {
+			return err
+		}
+		search := body.(map[string]interface{})
+		search["pit"] = map[string]interface{}{
+			"id":         pit,
+			"keep_alive": pointInTimeKeepAlive,
+		}
+
+		res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: http.MethodPost,
+			Path:   "/_search",
+			Body:   search,
+		})
+		if err != nil {
+			return err
+		}
+		r := pointInTimeSearchResult{}
+		if err := json.Unmarshal(res.Body, &r); err != nil {
+			return fmt.Errorf("could not decode search result of %s: %w", index, err)
+		}
+		if r.PitID != "" {
+			pit = r.PitID
+		}
+		if r.Hits == nil || len(r.Hits.Hits) == 0 {
+			return nil
+		}
+
+		if err := fn(r.Hits.Hits); err != nil {
+			return err
+		}
+		if len(r.Hits.Hits) < pageSize {
+			return nil
+		}
+		after = r.Hits.Hits[len(r.Hits.Hits)-1].Sort
+	}
+}
+
+func openPointInTime(ctx context.Context, client *elastic.Client, index string) (string, error) {
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPost,
+		Path:   fmt.Sprintf("/%s/_pit", url.PathEscape(index)),
+		Params: url.Values{"keep_alive": []string{pointInTimeKeepAlive}},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	r := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.Unmarshal(res.Body, &r); err != nil {
+		return "", fmt.Errorf("could not open point in time of %s: %w", index, err)
+	}
+	return r.ID, nil
+}
+
+func closePointInTime(ctx context.Context, client *elastic.Client, pit string) error {
+	_, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodDelete,
+		Path:   "/_pit",
+		Body:   map[string]interface{}{"id": pit},
+	})
+	return err
+}
@@ -2,9 +2,8 @@ package combind
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"io"
-	"reflect"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,47 +13,192 @@ import (
 )
 
 type elasticSearchBoxStorage struct {
-	client      *elastic.Client
-	searchIndex string
-	indexPrefix string
+	client        *elastic.Client
+	searchIndex   string
+	indexPrefix   string
+	hashAlgorithm HashAlgorithm
+	propMappings  map[string]interface{}
+	analyzers     map[string]interface{}
+	shards        int
+	replicas      int
+	retention     int
+	gates         []PublishGate
+	bulkOptions   BulkOptions
+	observer      Observer
 }
-type scrollResults struct {
-	data *elastic.SearchResult
-	err  error
+
+// ElasticSearchBoxStorageConfiguration configures the Elastic SearchBoxStorage
+type ElasticSearchBoxStorageConfiguration func(*elasticSearchBoxStorage)
+
+// WithHashAlgorithm sets the algorithm used for hash_match and the document ids,
+// stored as hash_version on every document. It panics on an unknown algorithm
+func WithHashAlgorithm(algorithm HashAlgorithm) ElasticSearchBoxStorageConfiguration {
+	if err := algorithm.Validate(); err != nil {
+		panic(err)
+	}
+	return func(s *elasticSearchBoxStorage) {
+		s.hashAlgorithm = algorithm
+	}
+}
+
+// WithPropMapping maps a prop of the SearchBoxes, e.g
+//
+//	WithPropMapping("name", map[string]interface{}{"type": "text", "analyzer": "names"})
+//
+// Props without a mapping are mapped dynamically
+func WithPropMapping(prop string, mapping map[string]interface{}) ElasticSearchBoxStorageConfiguration {
+	return func(s *elasticSearchBoxStorage) {
+		s.propMappings[prop] = mapping
+	}
+}
+
+// WithElasticObserver notifies the observer of the documents indexed and the
+// aliases rolled by the storage, instead of the observer of the context
+func WithElasticObserver(observer Observer) ElasticSearchBoxStorageConfiguration {
+	return func(s *elasticSearchBoxStorage) {
+		s.observer = observer
+	}
+}
+
+// WithAnalyzer adds a custom analyzer to the index settings, to be used by prop mappings
+func WithAnalyzer(name string, analyzer map[string]interface{}) ElasticSearchBoxStorageConfiguration {
+	return func(s *elasticSearchBoxStorage) {
+		s.analyzers[name] = analyzer
+	}
+}
+
+// WithShards sets the number of primary shards of every new index
+func WithShards(shards int) ElasticSearchBoxStorageConfiguration {
+	return func(s *elasticSearchBoxStorage) {
+		s.shards = shards
+	}
+}
+
+// WithReplicas sets the number of replicas of every new index
+func WithReplicas(replicas int) ElasticSearchBoxStorageConfiguration {
+	return func(s *elasticSearchBoxStorage) {
+		s.replicas = replicas
+	}
 }
 
-func NewElasticSearchBoxStorage(client *elastic.Client, alias string, indexPrefix string) SearchBoxStorage {
+// NewElasticSearchBoxStorage creates a SearchBoxStorage saving every build to a
+// new index named after the prefix and rolling the alias to it. New indexes
+// map key, type, hash_match, hash_version and every match.* field as keyword,
+// with a keyword subfield, so a new prop can't change how SearchBoxes are queried
+func NewElasticSearchBoxStorage(client *elastic.Client, alias string, indexPrefix string, cfg ...ElasticSearchBoxStorageConfiguration) SearchBoxStorage {
+
+	s := &elasticSearchBoxStorage{
+		client:        client,
+		searchIndex:   alias,
+		indexPrefix:   indexPrefix,
+		hashAlgorithm: DefaultHashAlgorithm,
+		propMappings:  map[string]interface{}{},
+		analyzers:     map[string]interface{}{},
+		replicas:      -1,
+		retention:     1,
+	}
+
+	for _, c := range cfg {
+		c(s)
+	}
+
+	return s
+}
+
+// keywordMapping maps a field as keyword, with a keyword subfield for queries on <field>.keyword
+func keywordMapping() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "keyword",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{
+				"type": "keyword",
+			},
+		},
+	}
+}
+
+// indexBody is the settings and mappings every new index is created with
+func (s *elasticSearchBoxStorage) indexBody() map[string]interface{} {
+	properties := map[string]interface{}{
+		"key":          keywordMapping(),
+		"type":         keywordMapping(),
+		"hash_match":   keywordMapping(),
+		"hash_version": keywordMapping(),
+	}
+	if len(s.propMappings) > 0 {
+		properties["props"] = map[string]interface{}{
+			"properties": s.propMappings,
+		}
+	}
+
+	settings := map[string]interface{}{}
+	if s.shards > 0 {
+		settings["number_of_shards"] = s.shards
+	}
+	if s.replicas >= 0 {
+		settings["number_of_replicas"] = s.replicas
+	}
+	if len(s.analyzers) > 0 {
+		settings["analysis"] = map[string]interface{}{
+			"analyzer": s.analyzers,
+		}
+	}
 
-	return &elasticSearchBoxStorage{
-		client:      client,
-		searchIndex: alias,
-		indexPrefix: indexPrefix,
+	return map[string]interface{}{
+		"settings": settings,
+		"mappings": map[string]interface{}{
+			"dynamic_templates": []interface{}{
+				map[string]interface{}{
+					"match_fields": map[string]interface{}{
+						"path_match": "match.*",
+						"mapping":    keywordMapping(),
+					},
+				},
+			},
+			"properties": properties,
+		},
 	}
 }
 
 func (s *elasticSearchBoxStorage) Find(ctx context.Context, boxType string) ([]SearchBox, error) {
+	return collectSearchBoxes(ctx, boxType, s.FindEach)
+}
 
+// FindEach reads the documents of a type sorted on key and groups them into whole SearchBoxes
+func (s *elasticSearchBoxStorage) FindEach(ctx context.Context, boxType string, fn func(*SearchBox) error) error {
 	bq := elastic.NewBoolQuery()
 
 	bq.Must(
 		elastic.NewTermQuery("type.keyword", boxType),
 	)
 
-	results := []SearchBox{}
-	for s := range scroll(s.client, ctx, s.searchIndex, bq) {
-		if s.err != nil {
-			return nil, s.err
-		}
-		var typ Component
-		for _, h := range s.data.Each(reflect.TypeOf(typ)) {
-			results = append(results, h.(SearchBox))
+	grouper := &searchBoxGrouper{fn: fn}
+	err := pages(ctx, s.client, s.searchIndex, bq, func(hits []*elastic.SearchHit) error {
+		for _, h := range hits {
+			d := SearchBox{}
+			if err := json.Unmarshal(h.Source, &d); err != nil {
+				return fmt.Errorf("could not decode document %s: %w", h.Id, err)
+			}
+			if err := grouper.add(d); err != nil {
+				return err
+			}
 		}
+		return nil
+	}, elastic.NewFieldSort("key.keyword"), elastic.NewFieldSort("hash_match.keyword"))
+	if err != nil {
+		return err
 	}
 
-	return results, nil
+	return grouper.flush()
 }
 
 func (s *elasticSearchBoxStorage) Save(ctx context.Context, sb ...*SearchBox) error {
+	return s.SaveEach(ctx, searchBoxSlice(sb))
+}
+
+// SaveEach indexes the documents of every SearchBox into a new index as source
+// sends them. The index is discarded when source fails, also when ctx is cancelled
+func (s *elasticSearchBoxStorage) SaveEach(ctx context.Context, source SearchBoxSource) error {
 	start := time.Now()
 	defer func() {
 		log.Debugf("indexing took %s ", time.Since(start))
@@ -67,86 +211,214 @@ func (s *elasticSearchBoxStorage) Save(ctx context.Context, sb ...*SearchBox) er
 		return err
 	}
 	if !exists {
-		if _, err := s.client.CreateIndex(originIdx).Do(ctx); err != nil {
+		if _, err := s.client.CreateIndex(originIdx).BodyJson(s.indexBody()).Do(ctx); err != nil {
 			return err
 		}
 	}
 
-	bp, err := elastic.NewBulkProcessorService(s.client).Stats(true).Do(ctx)
+	// the bulk processor is not cancelled with the build, so that the documents
+	// of a cancelled build are committed before the index is discarded
+	indexing, stopIndexing := context.WithCancel(context.Background())
+	defer stopIndexing()
+	bp, err := newBulkIndexer(indexing, s.client, s.bulkOptions)
 	if err != nil {
 		log.Error("Failed to create bulkprocessor")
+		s.discard(originIdx)
+		return err
 	}
-	defer bp.Close()
-	log.Debugf("Start indexing %d items", len(sb))
+	defer bp.close()
+	log.Debugf("Start indexing into %s", originIdx)
 
 	indexed := int64(0)
-	for _, d := range sb {
-		for _, key := range d.Matches {
-			dCopy := *d
-			dCopy.HashMatch = Hash(key)
-			dCopy.Match = key
-			dCopy.Matches = []Key{}
-			req := elastic.NewBulkIndexRequest().Index(originIdx).Id(fmt.Sprintf("%s_%s_%s", d.Type, d.Key, dCopy.HashMatch)).Doc(dCopy)
-			bp.Add(req)
+	err = source(func(d *SearchBox) error {
+		for _, dCopy := range searchBoxDocuments(d, s.hashAlgorithm) {
+			req := elastic.NewBulkIndexRequest().Index(originIdx).Id(searchBoxDocumentID(&dCopy)).Doc(dCopy)
+			bp.add(req)
 			indexed++
 			if indexed%1000 == 0 {
 				log.Debugf("Indexed done for %d documents", indexed)
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Building %s failed: %s", originIdx, err)
+		// commit the pending documents before the index is deleted, so they can't recreate it
+		stop := time.AfterFunc(discardTimeout, stopIndexing)
+		bp.close()
+		stop.Stop()
+		s.discard(originIdx)
+		return err
 	}
 
-	if err := bp.Flush(); err != nil {
+	if err := bp.flush(); err != nil {
+		log.Errorf("Indexing %s failed: %s", originIdx, err)
+		s.discard(originIdx)
 		return err
 	}
 
-	statsIndexed := bp.Stats().Indexed
+	statsIndexed := bp.indexed()
+	storageObserver(ctx, s.observer).DocumentsIndexed(ctx, originIdx, statsIndexed)
 	if statsIndexed != indexed {
 		log.Errorf("Expected %d documents, but count returned %d", indexed, statsIndexed)
-		if _, err := s.client.DeleteIndex(originIdx).Do(ctx); err != nil {
-			log.Errorf("Error while deleting new index %s", originIdx)
-			return err
-		}
+		s.discard(originIdx)
 		return fmt.Errorf("wrong number of documents indexed")
 	}
-	// roll alias
-	as := elastic.NewCatAliasesService(s.client)
-	r, err := as.Do(ctx)
+
+	if err := s.checkGates(ctx, originIdx); err != nil {
+		log.Errorf("Not publishing %s: %s", originIdx, err)
+		s.discard(originIdx)
+		return err
+	}
+
+	previous, err := s.rollAlias(ctx, originIdx)
 	if err != nil {
 		return err
 	}
 
-	als := elastic.NewAliasService(s.client)
+	s.prune(ctx, originIdx, previous)
+	return nil
+}
 
-	idxToDelete := []string{}
+// Apply writes the changes of a BuildDiff to the index behind the alias, without
+// creating a new index. Only the per-match documents of changed boxes are touched
+func (s *elasticSearchBoxStorage) Apply(ctx context.Context, diff BuildDiff) error {
+	start := time.Now()
+	defer func() {
+		log.Debugf("applying diff took %s ", time.Since(start))
+	}()
 
-	for _, row := range r {
-		if row.Alias == s.searchIndex {
-			als = als.Remove(row.Index, row.Alias)
-			idxToDelete = append(idxToDelete, row.Index)
+	if err := s.deleteStaleDocuments(ctx, diff); err != nil {
+		return err
+	}
+
+	bp, err := newBulkIndexer(ctx, s.client, s.bulkOptions)
+	if err != nil {
+		return err
+	}
+	defer bp.close()
+
+	indexed := int64(0)
+	for _, td := range diff {
+		for _, d := range append(td.Created, td.Updated...) {
+			for _, dCopy := range searchBoxDocuments(d, s.hashAlgorithm) {
+				req := elastic.NewBulkIndexRequest().Index(s.searchIndex).Id(searchBoxDocumentID(&dCopy)).Doc(dCopy)
+				bp.add(req)
+				indexed++
+			}
 		}
 	}
 
-	if _, err := als.Add(originIdx, s.searchIndex).Do(ctx); err != nil {
+	if err := bp.flush(); err != nil {
 		return err
 	}
 
-	if _, err := s.client.DeleteIndex(idxToDelete...).Do(ctx); err != nil {
-		log.Warn(err)
+	statsIndexed := bp.indexed()
+	storageObserver(ctx, s.observer).DocumentsIndexed(ctx, s.searchIndex, statsIndexed)
+	if statsIndexed != indexed {
+		log.Errorf("Expected %d documents, but count returned %d", indexed, statsIndexed)
+		return fmt.Errorf("wrong number of documents indexed")
 	}
 
 	return nil
 }
 
+// deleteBatchSize is the number of boxes whose documents are deleted by one delete by query
+const deleteBatchSize = 1000
+
+// staleBox is a box whose documents are deleted, except the ones with the kept ids
+type staleBox struct {
+	typ  string
+	key  string
+	keep []string
+}
+
+// deleteStaleDocuments removes the documents of the deleted boxes of a diff
+// and the documents of the updated boxes no longer built, with a delete by
+// query per deleteBatchSize boxes
+func (s *elasticSearchBoxStorage) deleteStaleDocuments(ctx context.Context, diff BuildDiff) error {
+	stale := []staleBox{}
+	for _, typ := range sortedDiffTypes(diff) {
+		td := diff[typ]
+		for _, d := range td.Deleted {
+			stale = append(stale, staleBox{typ: d.Type, key: d.Key})
+		}
+		for _, d := range td.Updated {
+			box := staleBox{typ: d.Type, key: d.Key}
+			for _, doc := range searchBoxDocuments(d, s.hashAlgorithm) {
+				box.keep = append(box.keep, searchBoxDocumentID(&doc))
+			}
+			stale = append(stale, box)
+		}
+	}
+
+	for start := 0; start < len(stale); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(stale) {
+			end = len(stale)
+		}
+		_, err := elastic.NewDeleteByQueryService(s.client).Index(s.searchIndex).
+			Query(staleDocumentsQuery(stale[start:end])).ProceedOnVersionConflict().Do(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleDocumentsQuery matches the documents of the boxes, per type on their
+// keys, except the kept documents. Kept ids embed the type and key of their box
+func staleDocumentsQuery(boxes []staleBox) elastic.Query {
+	keys := map[string][]interface{}{}
+	types := []string{}
+	keep := []string{}
+	for _, box := range boxes {
+		if _, ok := keys[box.typ]; !ok {
+			types = append(types, box.typ)
+		}
+		keys[box.typ] = append(keys[box.typ], box.key)
+		keep = append(keep, box.keep...)
+	}
+
+	bq := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	for _, typ := range types {
+		bq.Should(elastic.NewBoolQuery().Must(
+			elastic.NewTermQuery("type.keyword", typ),
+			elastic.NewTermsQuery("key.keyword", keys[typ]...),
+		))
+	}
+	if len(keep) > 0 {
+		bq.MustNot(elastic.NewIdsQuery().Ids(keep...))
+	}
+	return bq
+}
+
 type elasticComponentStorage struct {
 	client         *elastic.Client
 	componentIndex string
+	bulkOptions    BulkOptions
+	observer       Observer
 }
 
-func NewElasticComponentStorage(client *elastic.Client, componentIndex string) ComponentStorage {
-	return &elasticComponentStorage{
+// WithComponentObserver notifies the observer of the components indexed by the
+// storage, instead of the observer of the context
+func WithComponentObserver(observer Observer) ElasticComponentStorageConfiguration {
+	return func(s *elasticComponentStorage) {
+		s.observer = observer
+	}
+}
+
+func NewElasticComponentStorage(client *elastic.Client, componentIndex string, cfg ...ElasticComponentStorageConfiguration) ComponentStorage {
+	s := &elasticComponentStorage{
 		client:         client,
 		componentIndex: componentIndex,
 	}
+
+	for _, c := range cfg {
+		c(s)
+	}
+
+	return s
 }
 
 func (s *elasticComponentStorage) Find(ctx context.Context, componentType string) ([]BackendComponent, error) {
@@ -157,22 +429,19 @@ func (s *elasticComponentStorage) Find(ctx context.Context, componentType string
 		elastic.NewTermQuery("type.keyword", componentType),
 	)
 
-	results := []BackendComponent{}
-	for s := range scroll(s.client, ctx, s.componentIndex, bq) {
-		var typ BackendComponent
-		if s.err != nil {
-			return nil, s.err
-		}
-		for _, h := range s.data.Each(reflect.TypeOf(typ)) {
-			results = append(results, h.(BackendComponent))
-		}
-	}
-
-	return results, nil
+	return s.find(ctx, bq)
 }
 
 func (s *elasticComponentStorage) Search(ctx context.Context, componentType string, searchFilter SearchFilter) ([]BackendComponent, error) {
+	return s.find(ctx, searchQuery(componentType, searchFilter))
+}
 
+// SearchEach reads the matching components a page at a time
+func (s *elasticComponentStorage) SearchEach(ctx context.Context, componentType string, searchFilter SearchFilter, fn func(*BackendComponent) error) error {
+	return s.findEach(ctx, searchQuery(componentType, searchFilter), fn)
+}
+
+func searchQuery(componentType string, searchFilter SearchFilter) elastic.Query {
 	bq := elastic.NewBoolQuery()
 
 	bq.Must(
@@ -185,64 +454,43 @@ func (s *elasticComponentStorage) Search(ctx context.Context, componentType stri
 		)
 	}
 
-	results := []BackendComponent{}
-	for s := range scroll(s.client, ctx, s.componentIndex, bq) {
-		var typ BackendComponent
-		if s.err != nil {
-			return nil, s.err
-		}
-		for _, h := range s.data.Each(reflect.TypeOf(typ)) {
-			results = append(results, h.(BackendComponent))
-		}
-	}
-
-	return results, nil
+	return bq
 }
 
 func (s *elasticComponentStorage) Save(ctx context.Context, c ...*BackendComponent) error {
-	bp, err := elastic.NewBulkProcessorService(s.client).Do(ctx)
+	bp, err := newBulkIndexer(ctx, s.client, s.bulkOptions)
 	if err != nil {
 		return err
 	}
-	defer bp.Close()
+	defer bp.close()
 
 	for _, d := range c {
-		req := elastic.NewBulkIndexRequest().Index(s.componentIndex).Id(fmt.Sprintf("%s_%s", d.Type, d.Code)).Doc(d)
-		bp.Add(req)
+		req := elastic.NewBulkIndexRequest().Index(s.componentIndex).Id(componentID(d)).Doc(d)
+		bp.add(req)
 	}
 
-	return bp.Flush()
+	err = bp.flush()
+	storageObserver(ctx, s.observer).DocumentsIndexed(ctx, s.componentIndex, bp.indexed())
+	return err
 }
 
 func (s *elasticComponentStorage) Delete(ctx context.Context, c ...*BackendComponent) error {
-	bp, err := elastic.NewBulkProcessorService(s.client).Do(ctx)
+	bp, err := newBulkIndexer(ctx, s.client, s.bulkOptions)
 	if err != nil {
 		return err
 	}
-	defer bp.Close()
+	defer bp.close()
 
 	for _, d := range c {
-		bp.Add(elastic.NewBulkDeleteRequest().Index(s.componentIndex).Id(fmt.Sprintf("%s_%s", d.Type, d.Code)))
+		bp.add(elastic.NewBulkDeleteRequest().Index(s.componentIndex).Id(componentID(d)))
 	}
 
-	return bp.Flush()
+	return bp.flush()
 }
 
 func (s *elasticComponentStorage) FilteredDelete(ctx context.Context, componentType string, searchFilter SearchFilter) (int, error) {
 
-	bq := elastic.NewBoolQuery()
-
-	bq.Must(
-		elastic.NewTermQuery("type.keyword", componentType),
-	)
-
-	for k, v := range searchFilter {
-		bq.Must(
-			elastic.NewTermQuery(fmt.Sprintf("props.%s.keyword", k), v),
-		)
-	}
-
-	resp, err := elastic.NewDeleteByQueryService(s.client).Index(s.componentIndex).Query(bq).Do(ctx)
+	resp, err := elastic.NewDeleteByQueryService(s.client).Index(s.componentIndex).Query(searchQuery(componentType, searchFilter)).Do(ctx)
 
 	if err != nil {
 		return 0, err
@@ -252,29 +500,32 @@ func (s *elasticComponentStorage) FilteredDelete(ctx context.Context, componentT
 
 }
 
-func scroll(client *elastic.Client, ctx context.Context, index string, query elastic.Query) chan *scrollResults {
-	scroller := client.Scroll(index).Size(10000).Query(query)
-
-	results := make(chan *scrollResults, 3)
-	go func() {
-		defer close(results)
-		for {
-			r, err := scroller.Do(ctx)
-			if err == io.EOF {
-				//done
-				return
-			}
-			if err != nil {
-				log.Warnf("Error while scrolling %v", err)
-				results <- &scrollResults{
-					err: err,
-				}
-				return
+// find reads every component matching the query
+func (s *elasticComponentStorage) find(ctx context.Context, query elastic.Query) ([]BackendComponent, error) {
+	results := []BackendComponent{}
+	err := s.findEach(ctx, query, func(c *BackendComponent) error {
+		results = append(results, *c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// findEach calls fn with every component matching the query, a page at a time
+func (s *elasticComponentStorage) findEach(ctx context.Context, query elastic.Query, fn func(*BackendComponent) error) error {
+	return pages(ctx, s.client, s.componentIndex, query, func(hits []*elastic.SearchHit) error {
+		for _, h := range hits {
+			c := BackendComponent{}
+			if err := json.Unmarshal(h.Source, &c); err != nil {
+				return fmt.Errorf("could not decode component %s: %w", h.Id, err)
 			}
-			results <- &scrollResults{
-				data: r,
+			if err := fn(&c); err != nil {
+				return err
 			}
 		}
-	}()
-	return results
+		return nil
+	})
 }
@@ -0,0 +1,580 @@
+package combind_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func keywordField() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "keyword",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{"type": "keyword"},
+		},
+	}
+}
+
+func TestElasticSaveCreatesIndexWithMappings(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars",
+		combind.WithPropMapping("name", map[string]interface{}{"type": "text", "analyzer": "names"}),
+		combind.WithAnalyzer("names", map[string]interface{}{"type": "custom", "tokenizer": "standard"}),
+		combind.WithShards(3),
+		combind.WithReplicas(0),
+	)
+
+	assert.NoError(t, storage.Save(ctx, &combind.SearchBox{
+		Key:     "volvo",
+		Type:    "brand",
+		Props:   map[string]interface{}{"name": "Volvo"},
+		Matches: []combind.Key{{"brand": "volvo"}},
+	}))
+
+	index := fake.index("cars")
+	if !assert.NotNil(t, index) {
+		return
+	}
+	assert.Len(t, index.documents, 1)
+
+	body, err := json.Marshal(index.body)
+	assert.NoError(t, err)
+	expected, err := json.Marshal(map[string]interface{}{
+		"settings": map[string]interface{}{
+			"number_of_shards":   3,
+			"number_of_replicas": 0,
+			"analysis": map[string]interface{}{
+				"analyzer": map[string]interface{}{
+					"names": map[string]interface{}{"type": "custom", "tokenizer": "standard"},
+				},
+			},
+		},
+		"mappings": map[string]interface{}{
+			"dynamic_templates": []interface{}{
+				map[string]interface{}{
+					"match_fields": map[string]interface{}{
+						"path_match": "match.*",
+						"mapping":    keywordField(),
+					},
+				},
+			},
+			"properties": map[string]interface{}{
+				"key":          keywordField(),
+				"type":         keywordField(),
+				"hash_match":   keywordField(),
+				"hash_version": keywordField(),
+				"props": map[string]interface{}{
+					"properties": map[string]interface{}{
+						"name": map[string]interface{}{"type": "text", "analyzer": "names"},
+					},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(body))
+}
+
+func TestElasticSaveDefaultMappings(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars")
+
+	assert.NoError(t, storage.Save(ctx, &combind.SearchBox{Key: "volvo", Type: "brand", Matches: []combind.Key{{"brand": "volvo"}}}))
+
+	index := fake.index("cars")
+	if !assert.NotNil(t, index) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{}, index.body["settings"])
+	properties := index.body["mappings"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.NotContains(t, properties, "props")
+	assert.Equal(t, keywordField(), properties["type"])
+}
+
+func TestElasticRetentionHistoryAndRollback(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars", combind.WithRetention(2))
+	history := storage.(combind.SearchBoxHistory)
+
+	for _, brands := range [][]string{{"volvo"}, {"volvo", "saab"}, {"volvo", "saab", "audi"}} {
+		boxes := []*combind.SearchBox{}
+		for _, b := range brands {
+			boxes = append(boxes, &combind.SearchBox{Key: b, Type: "brand", Matches: []combind.Key{{"brand": b}}})
+		}
+		assert.NoError(t, storage.Save(ctx, boxes...))
+	}
+	assert.Len(t, fake.indexNames(), 2)
+
+	generations, err := history.History(ctx)
+	assert.NoError(t, err)
+	if !assert.Len(t, generations, 2) {
+		return
+	}
+	assert.Equal(t, int64(2), generations[0].Documents)
+	assert.False(t, generations[0].Active)
+	assert.Equal(t, int64(3), generations[1].Documents)
+	assert.True(t, generations[1].Active)
+	assert.True(t, generations[0].Created.Before(generations[1].Created))
+
+	assert.EqualError(t, history.Rollback(ctx, 2), "cannot roll back 2 steps, only 1 earlier indexes are retained")
+	assert.NoError(t, history.Rollback(ctx, 1))
+	assert.Len(t, fake.index("cars").documents, 2)
+
+	generations, err = history.History(ctx)
+	assert.NoError(t, err)
+	assert.True(t, generations[0].Active)
+	assert.False(t, generations[1].Active)
+}
+
+func TestElasticSaveAfterRollbackKeepsRolledBackIndex(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars", combind.WithRetention(2))
+	history := storage.(combind.SearchBoxHistory)
+
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo")...))
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo", "saab")...))
+	assert.NoError(t, history.Rollback(ctx, 1))
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo", "saab", "audi")...))
+	assert.Len(t, fake.indexNames(), 2)
+
+	generations, err := history.History(ctx)
+	assert.NoError(t, err)
+	if !assert.Len(t, generations, 2) {
+		return
+	}
+	assert.Equal(t, int64(1), generations[0].Documents)
+	assert.Equal(t, int64(3), generations[1].Documents)
+	assert.True(t, generations[1].Active)
+}
+
+func TestElasticSaveKeepsIndexOfConcurrentSave(t *testing.T) {
+	ctx := context.Background()
+	_, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars", combind.WithRetention(2))
+	history := storage.(combind.SearchBoxHistory)
+
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo")...))
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo", "saab")...))
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo", "saab", "audi")...))
+	assert.NoError(t, history.Rollback(ctx, 1))
+	generations, err := history.History(ctx)
+	assert.NoError(t, err)
+	if !assert.Len(t, generations, 2) {
+		return
+	}
+	rolledBackTo := generations[0].Index
+
+	// an index still being written by a Save in another process
+	indexing := "cars-1600000000-00000000-0000-0000-0000-000000000000"
+	_, err = client.CreateIndex(indexing).Do(ctx)
+	assert.NoError(t, err)
+
+	other := combind.NewElasticSearchBoxStorage(client, "cars", "cars", combind.WithRetention(2))
+	assert.NoError(t, other.Save(ctx, brandBoxes("bmw")...))
+
+	generations, err = history.History(ctx)
+	assert.NoError(t, err)
+	indexes := []string{}
+	for _, g := range generations {
+		indexes = append(indexes, g.Index)
+	}
+	if assert.Len(t, indexes, 3) {
+		assert.Equal(t, rolledBackTo, indexes[0])
+		assert.Equal(t, indexing, indexes[1])
+		assert.True(t, generations[2].Active)
+	}
+}
+
+func TestElasticSaveDeletesPreviousIndexByDefault(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars")
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, storage.Save(ctx, &combind.SearchBox{Key: "volvo", Type: "brand", Matches: []combind.Key{{"brand": "volvo"}}}))
+	}
+	assert.Len(t, fake.indexNames(), 1)
+}
+
+func brandBoxes(brands ...string) []*combind.SearchBox {
+	boxes := []*combind.SearchBox{}
+	for _, b := range brands {
+		boxes = append(boxes, &combind.SearchBox{Key: b, Type: "brand", Matches: []combind.Key{{"brand": b}}})
+	}
+	return boxes
+}
+
+func TestElasticPublishGates(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	custom := func(ctx context.Context, current *combind.IndexStats, previous *combind.IndexStats) error {
+		if current.Documents["brand"] > 3 {
+			return errors.New("too many brands")
+		}
+		return nil
+	}
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars", combind.WithPublishGates(
+		combind.MinDocuments("brand", 2),
+		combind.MaxNotMappedShare("cars", 0.5),
+		combind.MaxDrop(0.3),
+		custom,
+	))
+
+	err := storage.Save(ctx, brandBoxes("volvo")...)
+	assert.EqualError(t, err, fmt.Sprintf("index %s failed publish gates: 1 documents of type brand, expected at least 2", err.(*combind.PublishGateError).Index))
+	assert.Empty(t, fake.indexNames())
+
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo", "saab", "audi")...))
+	published := fake.indexNames()
+	assert.Len(t, published, 1)
+
+	cars := &combind.SearchBox{Key: combind.NotMappedKey, Type: "cars", Matches: []combind.Key{{"brand": "volvo"}}}
+	err = storage.Save(ctx, append(brandBoxes("volvo", "saab", "audi", "bmw"), cars)...)
+	gateErr, ok := err.(*combind.PublishGateError)
+	if assert.True(t, ok, err) {
+		assert.Len(t, gateErr.Failures, 2)
+		assert.EqualError(t, gateErr.Failures[0], "100.0% of type cars is not mapped, expected at most 50.0%")
+		assert.EqualError(t, gateErr.Failures[1], "too many brands")
+	}
+
+	err = storage.Save(ctx, brandBoxes("volvo", "saab")...)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "2 documents, 33.3% fewer than the previous 3, expected at most 30.0%")
+	}
+
+	assert.Equal(t, published, fake.indexNames())
+	assert.Len(t, fake.index("cars").documents, 3)
+}
+
+func rejectBroken(doc map[string]interface{}) string {
+	if doc["name"] == "broken" || doc["key"] == "broken" {
+		return "failed to parse field [props.year]"
+	}
+	return ""
+}
+
+func TestElasticComponentStorageReportsBulkFailures(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	fake.reject = rejectBroken
+	fake.autoCreate = true
+	storage := combind.NewElasticComponentStorage(client, "components",
+		combind.WithComponentBulkOptions(combind.BulkOptions{Workers: 2, Actions: 1}))
+
+	err := storage.Save(ctx,
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "broken"},
+	)
+	bulkErr, ok := err.(*combind.BulkError)
+	if assert.True(t, ok, err) {
+		assert.Equal(t, []combind.BulkFailure{{
+			ID:     "brand_saab",
+			Index:  "components",
+			Status: 400,
+			Type:   "mapper_parsing_exception",
+			Reason: "failed to parse field [props.year]",
+		}}, bulkErr.Failures)
+		assert.EqualError(t, err, "1 documents failed: brand_saab (mapper_parsing_exception: failed to parse field [props.year])")
+	}
+	assert.Len(t, fake.index("components").documents, 1)
+
+	assert.NoError(t, storage.Delete(ctx,
+		&combind.BackendComponent{Code: "volvo", Type: "brand"},
+		&combind.BackendComponent{Code: "saab", Type: "brand"},
+	))
+	assert.Empty(t, fake.index("components").documents)
+}
+
+func TestElasticSaveDiscardsIndexOnBulkFailures(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars",
+		combind.WithBulkOptions(combind.BulkOptions{Actions: 2, FlushInterval: time.Second}))
+
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo")...))
+	published := fake.indexNames()
+
+	fake.mu.Lock()
+	fake.reject = rejectBroken
+	fake.mu.Unlock()
+
+	err := storage.Save(ctx, brandBoxes("volvo", "saab", "broken")...)
+	bulkErr, ok := err.(*combind.BulkError)
+	if assert.True(t, ok, err) {
+		assert.Len(t, bulkErr.Failures, 1)
+		assert.Equal(t, "brand_broken_"+combind.Hash(combind.Key{"brand": "broken"}), bulkErr.Failures[0].ID)
+	}
+	assert.Equal(t, published, fake.indexNames())
+}
+
+func TestElasticSaveReturnsFailureWhenDiscardFails(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	fake.failDelete = true
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars",
+		combind.WithPublishGates(combind.MinDocuments("brand", 2)))
+
+	err := storage.Save(ctx, brandBoxes("volvo")...)
+	_, ok := err.(*combind.PublishGateError)
+	assert.True(t, ok, err)
+
+	fake.mu.Lock()
+	fake.reject = rejectBroken
+	fake.mu.Unlock()
+
+	err = storage.Save(ctx, brandBoxes("volvo", "saab", "broken")...)
+	_, ok = err.(*combind.BulkError)
+	assert.True(t, ok, err)
+}
+
+func TestElasticFindGroupsDocumentsIntoSearchBoxes(t *testing.T) {
+	ctx := context.Background()
+	_, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars")
+
+	assert.NoError(t, storage.Save(ctx,
+		&combind.SearchBox{Key: "volvo", Type: "cars", Props: map[string]interface{}{"name": "Volvo"}, Matches: []combind.Key{
+			{"brand": "volvo", "model": "xc90"},
+			{"brand": "volvo", "model": "v70"},
+		}},
+		&combind.SearchBox{Key: "audi", Type: "cars", Matches: []combind.Key{{"brand": "audi", "model": "a4"}}},
+		&combind.SearchBox{Key: "saab", Type: "brand", Matches: []combind.Key{{"brand": "saab"}}},
+	))
+
+	found, err := storage.Find(ctx, "cars")
+	assert.NoError(t, err)
+	if assert.Len(t, found, 2) {
+		assert.Equal(t, "audi", found[0].Key)
+		assert.Equal(t, "volvo", found[1].Key)
+		assert.Equal(t, map[string]interface{}{"name": "Volvo"}, found[1].Props)
+		assert.ElementsMatch(t, []combind.Key{
+			{"brand": "volvo", "model": "xc90"},
+			{"brand": "volvo", "model": "v70"},
+		}, found[1].Matches)
+	}
+
+	keys := []string{}
+	stop := errors.New("stop")
+	err = storage.(combind.StreamingSearchBoxStorage).FindEach(ctx, "cars", func(sb *combind.SearchBox) error {
+		keys = append(keys, sb.Key)
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []string{"audi"}, keys)
+}
+
+func TestElasticUpdateSeesExistingBoxes(t *testing.T) {
+	ctx := context.Background()
+	_, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars")
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+
+	g := combind.New(storage, combind.NewRoot("brand", components))
+	assert.NoError(t, g.Save(ctx))
+
+	volvo := &combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo Cars"}
+	assert.NoError(t, components.Save(ctx, volvo))
+
+	diff, err := g.Update(ctx, volvo)
+	assert.NoError(t, err)
+	assert.Empty(t, diff["brand"].Created)
+	assert.Empty(t, diff["brand"].Deleted)
+	if assert.Len(t, diff["brand"].Updated, 1) {
+		assert.Equal(t, "volvo", diff["brand"].Updated[0].Key)
+	}
+}
+
+func TestElasticComponentStorageReadsEveryPage(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	fake.autoCreate = true
+	storage := combind.NewElasticComponentStorage(client, "components")
+
+	components := []*combind.BackendComponent{}
+	for i := 0; i < 2500; i++ {
+		color := "red"
+		if i%2 == 0 {
+			color = "blue"
+		}
+		components = append(components, &combind.BackendComponent{
+			Code:  fmt.Sprintf("m%04d", i),
+			Type:  "model",
+			Props: map[string]interface{}{"color": color},
+		})
+	}
+	components = append(components, &combind.BackendComponent{Code: "volvo", Type: "brand"})
+	assert.NoError(t, storage.Save(ctx, components...))
+
+	found, err := storage.Find(ctx, "model")
+	assert.NoError(t, err)
+	assert.Len(t, found, 2500)
+	codes := map[string]bool{}
+	for _, c := range found {
+		codes[c.Code] = true
+	}
+	assert.Len(t, codes, 2500)
+
+	blue, err := storage.Search(ctx, "model", combind.SearchFilter{"color": "blue"})
+	assert.NoError(t, err)
+	assert.Len(t, blue, 1250)
+	assert.Equal(t, "blue", blue[0].Props["color"])
+
+	stop := errors.New("stop")
+	red := 0
+	err = storage.(combind.StreamingComponentStorage).SearchEach(ctx, "model", combind.SearchFilter{"color": "red"}, func(c *combind.BackendComponent) error {
+		assert.Equal(t, "red", c.Props["color"])
+		red++
+		if red == 1200 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1200, red)
+
+	assert.Zero(t, fake.openPointsInTime())
+}
+
+func TestElasticFindEachClosesPointInTime(t *testing.T) {
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars")
+	boxes := []*combind.SearchBox{}
+	for i := 0; i < 1500; i++ {
+		key := fmt.Sprintf("b%04d", i)
+		boxes = append(boxes, &combind.SearchBox{Key: key, Type: "brand", Matches: []combind.Key{{"brand": key}}})
+	}
+	assert.NoError(t, storage.Save(context.Background(), boxes...))
+
+	stop := errors.New("stop")
+	err := storage.(combind.StreamingSearchBoxStorage).FindEach(context.Background(), "brand", func(sb *combind.SearchBox) error {
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Zero(t, fake.openPointsInTime())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	err = storage.(combind.StreamingSearchBoxStorage).FindEach(ctx, "brand", func(sb *combind.SearchBox) error {
+		n++
+		cancel()
+		return nil
+	})
+	assert.True(t, errors.Is(err, context.Canceled), err)
+	assert.Less(t, n, 1500)
+	assert.Zero(t, fake.openPointsInTime())
+
+	found, err := storage.Find(context.Background(), "missing")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	_, err = combind.NewElasticSearchBoxStorage(client, "trucks", "trucks").Find(context.Background(), "brand")
+	assert.Error(t, err)
+	assert.Zero(t, fake.openPointsInTime())
+}
+
+func TestElasticSaveEachDiscardsIndexWhenSourceFails(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars")
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo")...))
+	published := fake.indexNames()
+
+	err := storage.(combind.StreamingSearchBoxStorage).SaveEach(ctx, func(emit func(*combind.SearchBox) error) error {
+		for _, sb := range brandBoxes("saab", "audi") {
+			if err := emit(sb); err != nil {
+				return err
+			}
+		}
+		return errors.New("build failed")
+	})
+	assert.EqualError(t, err, "build failed")
+	assert.Equal(t, published, fake.indexNames())
+
+	found, err := storage.Find(ctx, "brand")
+	assert.NoError(t, err)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, "volvo", found[0].Key)
+	}
+}
+
+func TestElasticSaveEachDiscardsIndexWhenBuildIsCancelled(t *testing.T) {
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars")
+	assert.NoError(t, storage.Save(context.Background(), brandBoxes("volvo")...))
+	published := fake.indexNames()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	err := storage.(combind.StreamingSearchBoxStorage).SaveEach(ctx, func(emit func(*combind.SearchBox) error) error {
+		for _, sb := range brandBoxes("saab", "audi") {
+			if err := emit(sb); err != nil {
+				return err
+			}
+		}
+		cancel()
+		return ctx.Err()
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, published, fake.indexNames())
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestElasticStorageObserver(t *testing.T) {
+	ctx := combind.ContextWithObserver(context.Background(), &recordingObserver{})
+	_, client := newFakeElastic(t)
+	observer := &recordingObserver{}
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars", combind.WithElasticObserver(observer))
+
+	assert.NoError(t, storage.Save(ctx, brandBoxes("volvo", "saab")...))
+	assert.Len(t, observer.events, 1)
+}
+
+func TestElasticApplyWritesOnlyTheChangedBoxes(t *testing.T) {
+	ctx := context.Background()
+	fake, client := newFakeElastic(t)
+	storage := combind.NewElasticSearchBoxStorage(client, "cars", "cars")
+
+	assert.NoError(t, storage.Save(ctx,
+		&combind.SearchBox{Key: "volvo", Type: "cars", Matches: []combind.Key{{"model": "v70"}, {"model": "xc90"}}},
+		&combind.SearchBox{Key: "saab", Type: "cars", Matches: []combind.Key{{"model": "9-5"}}},
+		&combind.SearchBox{Key: "volvo", Type: "brand", Matches: []combind.Key{{"brand": "volvo"}}},
+		&combind.SearchBox{Key: "saab", Type: "brand", Matches: []combind.Key{{"brand": "saab"}}},
+	))
+
+	assert.NoError(t, storage.Apply(ctx, combind.BuildDiff{
+		"cars": {
+			Created: []*combind.SearchBox{{Key: "audi", Type: "cars", Matches: []combind.Key{{"model": "a4"}}}},
+			Updated: []*combind.SearchBox{{Key: "volvo", Type: "cars", Props: map[string]interface{}{"name": "Volvo"}, Matches: []combind.Key{{"model": "xc90"}, {"model": "ex30"}}}},
+			Deleted: []*combind.SearchBox{{Key: "saab", Type: "cars", Matches: []combind.Key{{"model": "9-5"}}}},
+		},
+	}))
+	assert.Equal(t, 1, fake.deleteByQueries)
+
+	cars, err := storage.Find(ctx, "cars")
+	assert.NoError(t, err)
+	if assert.Len(t, cars, 2) {
+		assert.Equal(t, "audi", cars[0].Key)
+		assert.Equal(t, []combind.Key{{"model": "a4"}}, cars[0].Matches)
+		assert.Equal(t, "volvo", cars[1].Key)
+		assert.Equal(t, "Volvo", cars[1].Props["name"])
+		assert.ElementsMatch(t, []combind.Key{{"model": "xc90"}, {"model": "ex30"}}, cars[1].Matches)
+	}
+
+	brands, err := storage.Find(ctx, "brand")
+	assert.NoError(t, err)
+	assert.Len(t, brands, 2)
+}
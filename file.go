@@ -0,0 +1,403 @@
+package combind
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type fileSearchBoxStorage struct {
+	mu            sync.Mutex
+	dir           string
+	prefix        string
+	hashAlgorithm HashAlgorithm
+	observer      Observer
+}
+
+// FileSearchBoxStorageConfiguration configures the file SearchBoxStorage
+type FileSearchBoxStorageConfiguration func(*fileSearchBoxStorage)
+
+// WithFileHashAlgorithm sets the algorithm used for hash_match and the
+// document ids, stored as hash_version on every document. It panics on an
+// unknown algorithm
+func WithFileHashAlgorithm(algorithm HashAlgorithm) FileSearchBoxStorageConfiguration {
+	if err := algorithm.Validate(); err != nil {
+		panic(err)
+	}
+	return func(s *fileSearchBoxStorage) {
+		s.hashAlgorithm = algorithm
+	}
+}
+
+// WithFileObserver notifies the observer of the documents written by the
+// storage, instead of the observer of the context
+func WithFileObserver(observer Observer) FileSearchBoxStorageConfiguration {
+	return func(s *fileSearchBoxStorage) {
+		s.observer = observer
+	}
+}
+
+// NewFileSearchBoxStorage creates a SearchBoxStorage writing every Save and
+// Apply to a new version of an NDJSON file in dir, named
+// <prefix>-<version>.ndjson, with one match document per line sorted on type
+// and key. Find reads the latest version, earlier versions are kept as an
+// archive, see SearchBoxFileVersions and DiffSearchBoxFiles
+func NewFileSearchBoxStorage(dir string, prefix string, cfg ...FileSearchBoxStorageConfiguration) SearchBoxStorage {
+	s := &fileSearchBoxStorage{
+		dir:           dir,
+		prefix:        prefix,
+		hashAlgorithm: DefaultHashAlgorithm,
+	}
+
+	for _, c := range cfg {
+		c(s)
+	}
+
+	return s
+}
+
+func (s *fileSearchBoxStorage) Find(ctx context.Context, boxType string) ([]SearchBox, error) {
+	return collectSearchBoxes(ctx, boxType, s.FindEach)
+}
+
+// FindEach streams the documents of the latest version, written sorted on type and key
+func (s *fileSearchBoxStorage) FindEach(ctx context.Context, boxType string, fn func(*SearchBox) error) error {
+	s.mu.Lock()
+	versions, err := SearchBoxFileVersions(s.dir, s.prefix)
+	s.mu.Unlock()
+	if err != nil || len(versions) == 0 {
+		return err
+	}
+
+	f, err := os.Open(versions[len(versions)-1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	grouper := &searchBoxGrouper{fn: fn}
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		d := SearchBox{}
+		if err := decoder.Decode(&d); err == io.EOF {
+			return grouper.flush()
+		} else if err != nil {
+			return fmt.Errorf("could not read %s: %w", f.Name(), err)
+		}
+		if d.Type != boxType {
+			continue
+		}
+		if err := grouper.add(d); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fileSearchBoxStorage) Save(ctx context.Context, sb ...*SearchBox) error {
+	return s.SaveEach(ctx, searchBoxSlice(sb))
+}
+
+// SaveEach writes a new version once source has sent every SearchBox. The
+// documents are spooled to a file in dir as they are sent, only their
+// positions are held to write them sorted
+func (s *fileSearchBoxStorage) SaveEach(ctx context.Context, source SearchBoxSource) error {
+	spool, err := s.spool(source)
+	if err != nil {
+		return err
+	}
+	defer spool.close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(ctx, spool.writeTo, int64(len(spool.documents)))
+}
+
+// Apply writes a new version with the changes of a BuildDiff applied to the latest version
+func (s *fileSearchBoxStorage) Apply(ctx context.Context, diff BuildDiff) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	documents := map[string]SearchBox{}
+	versions, err := SearchBoxFileVersions(s.dir, s.prefix)
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		latest, err := ReadSearchBoxFile(versions[len(versions)-1])
+		if err != nil {
+			return err
+		}
+		for _, d := range latest {
+			documents[searchBoxDocumentID(&d)] = d
+		}
+	}
+
+	indexed := applyDocuments(documents, diff, s.hashAlgorithm)
+	return s.write(ctx, func(ctx context.Context, w io.Writer) error {
+		return writeSearchBoxDocuments(ctx, w, documents)
+	}, indexed)
+}
+
+// write stores the documents written by writeDocuments as the next version, renaming a complete file into place
+func (s *fileSearchBoxStorage) write(ctx context.Context, writeDocuments func(context.Context, io.Writer) error, indexed int64) error {
+	versions, err := SearchBoxFileVersions(s.dir, s.prefix)
+	if err != nil {
+		return err
+	}
+	version := 1
+	if len(versions) > 0 {
+		latest, _ := searchBoxFileVersion(versions[len(versions)-1], s.prefix)
+		version = latest + 1
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, s.prefix+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := writeDocuments(ctx, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%s-%06d.ndjson", s.prefix, version))
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	storageObserver(ctx, s.observer).DocumentsIndexed(ctx, path, indexed)
+	return nil
+}
+
+func writeSearchBoxDocuments(ctx context.Context, w io.Writer, documents map[string]SearchBox) error {
+	sorted := make([]SearchBox, 0, len(documents))
+	for _, d := range documents {
+		sorted = append(sorted, d)
+	}
+	sortSearchBoxDocuments(sorted)
+
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+	for i, d := range sorted {
+		if i%1000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := encoder.Encode(d); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// spooledDocument is the position of a document in a spool file
+type spooledDocument struct {
+	typ    string
+	key    string
+	hash   string
+	offset int64
+	length int
+}
+
+// searchBoxSpool holds the documents of a SaveEach in a temporary file
+type searchBoxSpool struct {
+	file      *os.File
+	documents map[string]spooledDocument
+}
+
+// spool writes the documents of the boxes sent by source to a temporary file,
+// a document sent again replacing the earlier one
+func (s *fileSearchBoxStorage) spool(source SearchBoxSource) (*searchBoxSpool, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(s.dir, s.prefix+"-*.spool")
+	if err != nil {
+		return nil, err
+	}
+	spool := &searchBoxSpool{
+		file:      f,
+		documents: map[string]spooledDocument{},
+	}
+
+	buf := bufio.NewWriter(f)
+	offset := int64(0)
+	err = source(func(d *SearchBox) error {
+		for _, doc := range searchBoxDocuments(d, s.hashAlgorithm) {
+			line, err := json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			line = append(line, '\n')
+			if _, err := buf.Write(line); err != nil {
+				return err
+			}
+			spool.documents[searchBoxDocumentID(&doc)] = spooledDocument{
+				typ:    doc.Type,
+				key:    doc.Key,
+				hash:   doc.HashMatch,
+				offset: offset,
+				length: len(line),
+			}
+			offset += int64(len(line))
+		}
+		return nil
+	})
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		spool.close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+// writeTo writes the spooled documents sorted on type, key and hash
+func (spool *searchBoxSpool) writeTo(ctx context.Context, w io.Writer) error {
+	sorted := make([]spooledDocument, 0, len(spool.documents))
+	for _, d := range spool.documents {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.hash < b.hash
+	})
+
+	buf := bufio.NewWriter(w)
+	line := []byte{}
+	for i, d := range sorted {
+		if i%1000 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if cap(line) < d.length {
+			line = make([]byte, d.length)
+		}
+		line = line[:d.length]
+		if _, err := spool.file.ReadAt(line, d.offset); err != nil {
+			return fmt.Errorf("could not read %s: %w", spool.file.Name(), err)
+		}
+		if _, err := buf.Write(line); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+func (spool *searchBoxSpool) close() {
+	spool.file.Close()
+	os.Remove(spool.file.Name())
+}
+
+// SearchBoxFileVersions returns the paths of the versions written by a file
+// SearchBoxStorage in dir with the prefix, oldest first
+func SearchBoxFileVersions(dir string, prefix string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, prefix+"-*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := map[string]int{}
+	result := []string{}
+	for _, p := range paths {
+		if v, ok := searchBoxFileVersion(p, prefix); ok {
+			versions[p] = v
+			result = append(result, p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return versions[result[i]] < versions[result[j]]
+	})
+
+	return result, nil
+}
+
+func searchBoxFileVersion(path string, prefix string) (int, bool) {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, prefix+"-") || !strings.HasSuffix(name, ".ndjson") {
+		return 0, false
+	}
+	v, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix+"-"), ".ndjson"))
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// ReadSearchBoxFile reads the match documents of an NDJSON file
+func ReadSearchBoxFile(path string) ([]SearchBox, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	documents := []SearchBox{}
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		d := SearchBox{}
+		if err := decoder.Decode(&d); err == io.EOF {
+			return documents, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", path, err)
+		}
+		documents = append(documents, d)
+	}
+}
+
+// DiffSearchBoxFiles compares two NDJSON files, e.g two versions of a file
+// SearchBoxStorage, and returns the changes from the first to the second
+func DiffSearchBoxFiles(from string, to string) (BuildDiff, error) {
+	before, err := ReadSearchBoxFile(from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := ReadSearchBoxFile(to)
+	if err != nil {
+		return nil, err
+	}
+
+	byType := func(documents []SearchBox) map[string][]SearchBox {
+		types := map[string][]SearchBox{}
+		for _, d := range documents {
+			types[d.Type] = append(types[d.Type], d)
+		}
+		return types
+	}
+	beforeTypes := byType(before)
+	afterTypes := byType(after)
+
+	diff := BuildDiff{}
+	for _, types := range []map[string][]SearchBox{beforeTypes, afterTypes} {
+		for typ := range types {
+			diff[typ] = diffSearchBoxes(groupSearchBoxes(beforeTypes[typ]), groupSearchBoxes(afterTypes[typ]))
+		}
+	}
+
+	return diff, nil
+}
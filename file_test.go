@@ -0,0 +1,104 @@
+package combind_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSearchBoxStorageVersions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+	boxes := combind.NewFileSearchBoxStorage(dir, "cars")
+
+	found, err := boxes.Find(ctx, "brand")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	g := combind.New(boxes, combind.NewRoot("brand", components))
+	assert.NoError(t, g.Save(ctx))
+
+	found, err = boxes.Find(ctx, "brand")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"saab", "volvo"}, []string{found[0].Key, found[1].Key})
+	assert.Equal(t, []combind.Key{{"brand": "saab"}}, found[0].Matches)
+
+	audi := &combind.BackendComponent{Code: "audi", Type: "brand", Name: "Audi"}
+	saab := &combind.BackendComponent{Code: "saab", Type: "brand"}
+	assert.NoError(t, components.Save(ctx, audi))
+	assert.NoError(t, components.Delete(ctx, saab))
+
+	diff, err := g.Update(ctx, audi, saab)
+	assert.NoError(t, err)
+	assert.NoError(t, boxes.Apply(ctx, diff))
+
+	found, err = boxes.Find(ctx, "brand")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"audi", "volvo"}, []string{found[0].Key, found[1].Key})
+
+	versions, err := combind.SearchBoxFileVersions(dir, "cars")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "cars-000001.ndjson"),
+		filepath.Join(dir, "cars-000002.ndjson"),
+	}, versions)
+
+	first, err := combind.ReadSearchBoxFile(versions[0])
+	assert.NoError(t, err)
+	assert.Len(t, first, 2)
+
+	archived, err := combind.DiffSearchBoxFiles(versions[0], versions[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "audi", archived["brand"].Created[0].Key)
+	assert.Equal(t, "saab", archived["brand"].Deleted[0].Key)
+	assert.Empty(t, archived["brand"].Updated)
+}
+
+func TestFileSearchBoxStorageSaveEachSpoolsDocuments(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	boxes := combind.NewFileSearchBoxStorage(dir, "cars").(combind.StreamingSearchBoxStorage)
+
+	err := boxes.SaveEach(ctx, func(emit func(*combind.SearchBox) error) error {
+		for _, sb := range []*combind.SearchBox{
+			{Key: "volvo", Type: "brand", Props: map[string]interface{}{"name": "Volvo"}, Matches: []combind.Key{{"model": "xc90"}}},
+			{Key: "saab", Type: "brand", Props: map[string]interface{}{"name": "Saab"}, Matches: []combind.Key{{"model": "9-5"}}},
+			{Key: "volvo", Type: "brand", Props: map[string]interface{}{"name": "Volvo"}, Matches: []combind.Key{{"model": "v70"}, {"model": "xc90"}}},
+		} {
+			if err := emit(sb); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	found, err := boxes.Find(ctx, "brand")
+	assert.NoError(t, err)
+	if assert.Len(t, found, 2) {
+		assert.Equal(t, "saab", found[0].Key)
+		assert.Equal(t, "volvo", found[1].Key)
+		assert.ElementsMatch(t, []combind.Key{{"model": "v70"}, {"model": "xc90"}}, found[1].Matches)
+	}
+
+	failed := errors.New("build failed")
+	err = boxes.SaveEach(ctx, func(emit func(*combind.SearchBox) error) error {
+		if err := emit(&combind.SearchBox{Key: "audi", Type: "brand", Matches: []combind.Key{{"model": "a4"}}}); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.Equal(t, failed, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "cars-000001.ndjson")}, files)
+}
@@ -3,10 +3,11 @@ module github.com/ourstudio-se/combind/v2
 go 1.15
 
 require (
-	github.com/google/go-cmp v0.5.4
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/google/go-cmp v0.5.4 // indirect
+	github.com/google/uuid v1.3.0
 	github.com/olivere/elastic/v7 v7.0.22
 	github.com/reveald/reveald v0.0.0-20201127082602-536c61456ca8
 	github.com/sirupsen/logrus v1.8.0
 	github.com/stretchr/testify v1.6.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -2,17 +2,165 @@ package combind
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"hash"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// HashAlgorithm identifies the key encoding and digest used for hash_match.
+// It is stored as hash_version next to every hash_match
+type HashAlgorithm string
+
+const (
+	// HashLegacyMD5 is MD5 over the Go formatting of the key, the unversioned original hash
+	HashLegacyMD5 HashAlgorithm = "md5-v1"
+	// HashCanonicalMD5 is MD5 over the canonical key encoding
+	HashCanonicalMD5 HashAlgorithm = "md5-v2"
+	// HashCanonicalSHA256 is SHA-256 over the canonical key encoding
+	HashCanonicalSHA256 HashAlgorithm = "sha256-v2"
+)
+
+// DefaultHashAlgorithm is the algorithm used by Hash and by the storages unless
+// configured otherwise. It is the original hash, so existing hash_match values
+// and document ids stay valid, the canonical algorithms are opt-in
+const DefaultHashAlgorithm = HashLegacyMD5
+
+// Validate returns an error for an algorithm HashWith doesn't know
+func (algorithm HashAlgorithm) Validate() error {
+	switch algorithm {
+	case HashLegacyMD5, HashCanonicalMD5, HashCanonicalSHA256:
+		return nil
+	default:
+		return fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+}
+
 // Hash generates a hash of this key object
 func Hash(key map[string]interface{}) string {
-	h := md5.New()
-	if _, err := h.Write([]byte(fmt.Sprintf("%v", key))); err != nil {
+	return HashWith(DefaultHashAlgorithm, key)
+}
+
+// HashWith generates a hash of this key object with the given algorithm. It
+// panics on an unknown algorithm, see HashAlgorithm.Validate
+func HashWith(algorithm HashAlgorithm, key map[string]interface{}) string {
+	var h hash.Hash
+	var encoded string
+	switch algorithm {
+	case HashLegacyMD5:
+		h = md5.New()
+		encoded = fmt.Sprintf("%v", key)
+	case HashCanonicalMD5:
+		h = md5.New()
+		encoded = CanonicalKey(key)
+	case HashCanonicalSHA256:
+		h = sha256.New()
+		encoded = CanonicalKey(key)
+	default:
+		panic(algorithm.Validate())
+	}
+
+	if _, err := h.Write([]byte(encoded)); err != nil {
 		log.Errorf("error generating has for ket %v", key)
 	}
 
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
+
+// CanonicalKey encodes a key with its fields sorted and every value tagged with
+// its type, e.g. {"year": 2020, "brand": "volvo"} becomes {brand=s:volvo;year=n:2020}.
+// All numbers share the n tag so that a key survives a JSON round trip.
+// The separators {}[];,= and \ are escaped in names and string values
+func CanonicalKey(key map[string]interface{}) string {
+	sb := &strings.Builder{}
+	encodeCanonical(sb, key)
+	return sb.String()
+}
+
+var canonicalEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`[`, `\[`,
+	`]`, `\]`,
+	`;`, `\;`,
+	`,`, `\,`,
+	`=`, `\=`,
+)
+
+func encodeCanonical(sb *strings.Builder, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		sb.WriteString("z:")
+	case string:
+		sb.WriteString("s:")
+		sb.WriteString(canonicalEscaper.Replace(v))
+	case bool:
+		sb.WriteString("b:")
+		sb.WriteString(strconv.FormatBool(v))
+	case int, int8, int16, int32, int64:
+		sb.WriteString("n:")
+		sb.WriteString(strconv.FormatInt(reflect.ValueOf(v).Int(), 10))
+	case uint, uint8, uint16, uint32, uint64:
+		sb.WriteString("n:")
+		sb.WriteString(strconv.FormatUint(reflect.ValueOf(v).Uint(), 10))
+	case float32:
+		sb.WriteString("n:")
+		sb.WriteString(strconv.FormatFloat(float64(v), 'f', -1, 32))
+	case float64:
+		sb.WriteString("n:")
+		sb.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			encodeCanonical(sb, f)
+		} else {
+			sb.WriteString("n:")
+			sb.WriteString(v.String())
+		}
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		sb.WriteString("{")
+		for i, name := range names {
+			if i > 0 {
+				sb.WriteString(";")
+			}
+			sb.WriteString(canonicalEscaper.Replace(name))
+			sb.WriteString("=")
+			encodeCanonical(sb, v[name])
+		}
+		sb.WriteString("}")
+	case []interface{}:
+		sb.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			encodeCanonical(sb, item)
+		}
+		sb.WriteString("]")
+	default:
+		// other types are encoded through their JSON representation
+		b, err := json.Marshal(v)
+		if err != nil {
+			log.Errorf("error encoding key value %v", v)
+		}
+		var generic interface{}
+		if err := json.Unmarshal(b, &generic); err != nil {
+			sb.WriteString("j:")
+			sb.WriteString(canonicalEscaper.Replace(string(b)))
+			return
+		}
+		encodeCanonical(sb, generic)
+	}
+}
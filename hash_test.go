@@ -66,3 +66,53 @@ func TestNotEqualWhenSameNumberOfParams(t *testing.T) {
 	h2 := combind.Hash(map2)
 	assert.NotEqual(t, h1, h2)
 }
+
+func TestNotEqualWhenSameValueWithDifferentType(t *testing.T) {
+	h1 := combind.HashWith(combind.HashCanonicalSHA256, map[string]interface{}{"year": 2020})
+	h2 := combind.HashWith(combind.HashCanonicalSHA256, map[string]interface{}{"year": "2020"})
+	assert.NotEqual(t, h1, h2)
+}
+
+func TestEqualForNumbersAfterJSONRoundTrip(t *testing.T) {
+	h1 := combind.HashWith(combind.HashCanonicalSHA256, map[string]interface{}{"year": 2020})
+	h2 := combind.HashWith(combind.HashCanonicalSHA256, map[string]interface{}{"year": float64(2020)})
+	assert.Equal(t, h1, h2)
+}
+
+func TestNotEqualWhenSeparatorsInValues(t *testing.T) {
+	h1 := combind.HashWith(combind.HashCanonicalSHA256, map[string]interface{}{"k1": "v1;k2=v2"})
+	h2 := combind.HashWith(combind.HashCanonicalSHA256, map[string]interface{}{"k1": "v1", "k2": "v2"})
+	assert.NotEqual(t, h1, h2)
+}
+
+func TestHashIsTheLegacyHash(t *testing.T) {
+	// md5 of "map[brand:volvo model:v70]"
+	assert.Equal(t, "c41120e9dbb3fee5cfc3d6876c21b51c", combind.Hash(map[string]interface{}{"brand": "volvo", "model": "v70"}))
+}
+
+func TestUnknownHashAlgorithm(t *testing.T) {
+	assert.EqualError(t, combind.HashAlgorithm("crc32").Validate(), `unknown hash algorithm "crc32"`)
+	assert.Panics(t, func() { combind.HashWith("crc32", map[string]interface{}{"k1": "v1"}) })
+	assert.Panics(t, func() { combind.WithHashAlgorithm("crc32") })
+	assert.Panics(t, func() { combind.WithFileHashAlgorithm("crc32") })
+}
+
+func TestCanonicalKey(t *testing.T) {
+	key := map[string]interface{}{
+		"model": "v70",
+		"year":  2020,
+		"extra": map[string]interface{}{"b": true, "a": []interface{}{"x,y", nil}},
+	}
+
+	assert.Equal(t, `{extra={a=[s:x\,y,z:];b=b:true};model=s:v70;year=n:2020}`, combind.CanonicalKey(key))
+}
+
+func TestHashWithAlgorithms(t *testing.T) {
+	key := map[string]interface{}{"k1": "v1"}
+
+	assert.Len(t, combind.HashWith(combind.HashLegacyMD5, key), 32)
+	assert.Len(t, combind.HashWith(combind.HashCanonicalMD5, key), 32)
+	assert.Len(t, combind.HashWith(combind.HashCanonicalSHA256, key), 64)
+	assert.Equal(t, combind.HashWith(combind.DefaultHashAlgorithm, key), combind.Hash(key))
+	assert.NotEqual(t, combind.HashWith(combind.HashLegacyMD5, key), combind.HashWith(combind.HashCanonicalMD5, key))
+}
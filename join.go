@@ -0,0 +1,230 @@
+package combind
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// JoinDependencies combines the boxes of the dependencies like DependencyMerge,
+// but only produces combinations with at least one compatible match. Each
+// dependency's matches are indexed on the key fields they share with the
+// combination built so far, so incompatible pairs are never visited. Every
+// dependency is joined in its own goroutine, in the given order, and the
+// output order follows the order of the boxes
+func JoinDependencies(ctx context.Context, dependencies ...[]*SearchBox) chan *Combination {
+	return joinDependencies(ctx, combinerOptions{}, dependencies...)
+}
+
+func joinDependencies(ctx context.Context, options combinerOptions, dependencies ...[]*SearchBox) chan *Combination {
+	first := make(chan *Combination, options.bufferSize)
+	if len(dependencies) == 0 {
+		close(first)
+		return first
+	}
+
+	go func() {
+		defer close(first)
+		for _, sb := range dependencies[0] {
+			if len(sb.Matches) == 0 {
+				continue
+			}
+			if !sendCombination(ctx, first, &Combination{
+				Types: map[string]*SearchBox{
+					sb.Type: sb,
+				},
+				Matches: sb.Matches,
+			}) {
+				return
+			}
+		}
+	}()
+
+	results := first
+	for _, dependency := range dependencies[1:] {
+		results = joinDependency(ctx, options, results, dependency)
+	}
+
+	return results
+}
+
+// JoinCombiner is a ContextCombiner joining all dependencies with JoinDependencies, in type order
+func JoinCombiner(opts ...CombinerOption) ContextCombiner {
+	options := newCombinerOptions(opts)
+	return func(ctx context.Context, dependency map[string][]*SearchBox) chan *Combination {
+		return joinDependencies(ctx, options, sortedDependencies(dependency)...)
+	}
+}
+
+func sortedDependencies(dependency map[string][]*SearchBox) [][]*SearchBox {
+	types := []string{}
+	for typ := range dependency {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	dependencies := [][]*SearchBox{}
+	for _, typ := range types {
+		dependencies = append(dependencies, dependency[typ])
+	}
+	return dependencies
+}
+
+func joinDependency(ctx context.Context, options combinerOptions, results chan *Combination, dependency []*SearchBox) chan *Combination {
+	joined := make(chan *Combination, options.bufferSize)
+
+	go func() {
+		defer close(joined)
+		index := newJoinIndex(dependency)
+
+		for {
+			var r *Combination
+			select {
+			case <-ctx.Done():
+				return
+			case c, ok := <-results:
+				if !ok {
+					return
+				}
+				r = c
+			}
+
+			matches := map[int][]Key{}
+			for _, m := range r.Matches {
+				index.probe(m, func(e *joinEntry) {
+					if merged, ok := MergeKey(m, e.match); ok {
+						matches[e.box] = append(matches[e.box], merged)
+					}
+				})
+			}
+
+			boxes := make([]int, 0, len(matches))
+			for box := range matches {
+				boxes = append(boxes, box)
+			}
+			sort.Ints(boxes)
+
+			for _, box := range boxes {
+				d := dependency[box]
+				ts := map[string]*SearchBox{
+					d.Type: d,
+				}
+				for _, t := range r.Types {
+					ts[t.Type] = t
+				}
+
+				if !sendCombination(ctx, joined, &Combination{
+					Types:   ts,
+					Matches: dedupMergedKeys(matches[box]),
+				}) {
+					return
+				}
+			}
+		}
+	}()
+
+	return joined
+}
+
+type joinEntry struct {
+	box   int
+	match Key
+}
+
+// joinGroup holds the matches sharing the same set of key fields, indexed
+// lazily on every subset of fields they are probed with
+type joinGroup struct {
+	fields  map[string]bool
+	entries []*joinEntry
+	indexes map[string]map[string][]*joinEntry
+}
+
+type joinIndex struct {
+	groups []*joinGroup
+}
+
+func newJoinIndex(dependency []*SearchBox) *joinIndex {
+	index := &joinIndex{}
+	groups := map[string]*joinGroup{}
+
+	for i, sb := range dependency {
+		for _, m := range sb.Matches {
+			names := sortedFields(m, nil)
+			signature := strings.Join(names, "\x00")
+			g, ok := groups[signature]
+			if !ok {
+				g = &joinGroup{
+					fields:  map[string]bool{},
+					indexes: map[string]map[string][]*joinEntry{},
+				}
+				for _, name := range names {
+					g.fields[name] = true
+				}
+				groups[signature] = g
+				index.groups = append(index.groups, g)
+			}
+			g.entries = append(g.entries, &joinEntry{box: i, match: m})
+		}
+	}
+
+	return index
+}
+
+// probe calls fn for every entry agreeing with m on the fields they share
+func (index *joinIndex) probe(m Key, fn func(e *joinEntry)) {
+	for _, g := range index.groups {
+		shared := sortedFields(m, g.fields)
+		if len(shared) == 0 {
+			for _, e := range g.entries {
+				fn(e)
+			}
+			continue
+		}
+
+		projection, ok := projectKey(m, shared)
+		if !ok {
+			continue
+		}
+
+		signature := strings.Join(shared, "\x00")
+		idx, ok := g.indexes[signature]
+		if !ok {
+			idx = map[string][]*joinEntry{}
+			for _, e := range g.entries {
+				if p, ok := projectKey(e.match, shared); ok {
+					idx[p] = append(idx[p], e)
+				}
+			}
+			g.indexes[signature] = idx
+		}
+
+		for _, e := range idx[projection] {
+			fn(e)
+		}
+	}
+}
+
+// sortedFields returns the sorted field names of a key, limited to the given fields when not nil
+func sortedFields(k Key, only map[string]bool) []string {
+	names := make([]string, 0, len(k))
+	for name := range k {
+		if only == nil || only[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// projectKey encodes the values of the given fields the way MergeKey compares them
+func projectKey(k Key, fields []string) (string, bool) {
+	buf := []byte{}
+	for _, name := range fields {
+		s, ok := keyString(k[name])
+		if !ok {
+			return "", false
+		}
+		buf = appendLengthPrefixed(buf, s)
+	}
+	return string(buf), true
+}
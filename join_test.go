@@ -0,0 +1,109 @@
+package combind_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func combinationSignatures(ch chan *combind.Combination) []string {
+	signatures := []string{}
+	for c := range ch {
+		if len(c.Matches) == 0 {
+			continue
+		}
+		types := []string{}
+		for typ, sb := range c.Types {
+			types = append(types, typ+"="+sb.Key)
+		}
+		sort.Strings(types)
+		matches := []string{}
+		for _, m := range c.Matches {
+			matches = append(matches, combind.CanonicalKey(m))
+		}
+		sort.Strings(matches)
+		signatures = append(signatures, fmt.Sprint(types, matches))
+	}
+	sort.Strings(signatures)
+	return signatures
+}
+
+func marketBoxes() ([]*combind.SearchBox, []*combind.SearchBox, []*combind.SearchBox) {
+	brands := []*combind.SearchBox{
+		{Key: "volvo", Type: "brand", Matches: []combind.Key{{"brand": "volvo"}}},
+		{Key: "saab", Type: "brand", Matches: []combind.Key{{"brand": "saab"}}},
+	}
+	models := []*combind.SearchBox{
+		{Key: "v70", Type: "model", Matches: []combind.Key{{"brand": "volvo", "model": "v70"}}},
+		{Key: "xc90", Type: "model", Matches: []combind.Key{{"brand": "volvo", "model": "xc90"}}},
+		{Key: "9-5", Type: "model", Matches: []combind.Key{{"brand": "saab", "model": "9-5"}}},
+	}
+	markets := []*combind.SearchBox{
+		{Key: "nordics", Type: "market", Matches: []combind.Key{
+			{"market": "se", "model": "v70"},
+			{"market": "no", "model": "v70"},
+			{"market": "se", "model": "9-5"},
+		}},
+		{Key: "global", Type: "market", Matches: []combind.Key{{"market": "any"}}},
+	}
+	return brands, models, markets
+}
+
+func TestJoinDependenciesMatchesDependencyMerge(t *testing.T) {
+	ctx := context.Background()
+	brands, models, markets := marketBoxes()
+
+	joined := combinationSignatures(combind.JoinDependencies(ctx, brands, models, markets))
+	merged := combinationSignatures(combind.DependencyMergeContext(ctx, nil, brands, models, markets))
+
+	assert.Len(t, joined, 5)
+	assert.Equal(t, merged, joined)
+}
+
+func TestJoinDependenciesOrder(t *testing.T) {
+	ctx := context.Background()
+	brands, models, _ := marketBoxes()
+
+	keys := []string{}
+	for c := range combind.JoinDependencies(ctx, brands, models) {
+		keys = append(keys, c.Types["brand"].Key+"/"+c.Types["model"].Key)
+	}
+
+	assert.Equal(t, []string{"volvo/v70", "volvo/xc90", "saab/9-5"}, keys)
+}
+
+func BenchmarkJoinDependencies(b *testing.B) {
+	ctx := context.Background()
+	brands, models := joinBenchmarkBoxes()
+	for i := 0; i < b.N; i++ {
+		for range combind.JoinDependencies(ctx, brands, models) {
+		}
+	}
+}
+
+func BenchmarkDependencyMerge(b *testing.B) {
+	ctx := context.Background()
+	brands, models := joinBenchmarkBoxes()
+	for i := 0; i < b.N; i++ {
+		for range combind.DependencyMergeContext(ctx, nil, brands, models) {
+		}
+	}
+}
+
+func joinBenchmarkBoxes() ([]*combind.SearchBox, []*combind.SearchBox) {
+	brands := []*combind.SearchBox{}
+	models := []*combind.SearchBox{}
+	for i := 0; i < 100; i++ {
+		brand := fmt.Sprintf("brand%d", i)
+		brands = append(brands, &combind.SearchBox{Key: brand, Type: "brand", Matches: []combind.Key{{"brand": brand}}})
+		for j := 0; j < 10; j++ {
+			model := fmt.Sprintf("%s-model%d", brand, j)
+			models = append(models, &combind.SearchBox{Key: model, Type: "model", Matches: []combind.Key{{"brand": brand, "model": model}}})
+		}
+	}
+	return brands, models
+}
@@ -0,0 +1,91 @@
+package combind
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// matchSpool holds the matches of rule results in a temporary file, a JSON
+// line per result, for the boxes to be sent once their Props are resolved
+type matchSpool struct {
+	file   *os.File
+	buf    *bufio.Writer
+	offset int64
+}
+
+// spooledMatches is the position of the matches of a rule result in a spool file
+type spooledMatches struct {
+	offset int64
+	length int
+}
+
+func newMatchSpool() (*matchSpool, error) {
+	f, err := ioutil.TempFile("", "combind-*.spool")
+	if err != nil {
+		return nil, err
+	}
+	return &matchSpool{
+		file: f,
+		buf:  bufio.NewWriter(f),
+	}, nil
+}
+
+func (spool *matchSpool) write(matches []Key) (spooledMatches, error) {
+	line, err := json.Marshal(matches)
+	if err != nil {
+		return spooledMatches{}, err
+	}
+	line = append(line, '\n')
+	if _, err := spool.buf.Write(line); err != nil {
+		return spooledMatches{}, err
+	}
+	spooled := spooledMatches{
+		offset: spool.offset,
+		length: len(line),
+	}
+	spool.offset += int64(len(line))
+	return spooled, nil
+}
+
+// flush makes the written matches readable
+func (spool *matchSpool) flush() error {
+	return spool.buf.Flush()
+}
+
+// read returns the spooled matches of the rule results, decoded from JSON like
+// the matches read from a storage
+func (spool *matchSpool) read(spooled ...spooledMatches) ([]Key, error) {
+	matches := []Key{}
+	line := []byte{}
+	for _, sm := range spooled {
+		if cap(line) < sm.length {
+			line = make([]byte, sm.length)
+		}
+		line = line[:sm.length]
+		if _, err := spool.file.ReadAt(line, sm.offset); err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", spool.file.Name(), err)
+		}
+		result := []Key{}
+		if err := json.Unmarshal(line, &result); err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", spool.file.Name(), err)
+		}
+		matches = append(matches, result...)
+	}
+	return matches, nil
+}
+
+func (spool *matchSpool) close() {
+	spool.file.Close()
+	os.Remove(spool.file.Name())
+}
+
+// matchID is the Hash of a match as the 16 bytes of the default md5 digest
+func matchID(match Key) [16]byte {
+	var id [16]byte
+	hex.Decode(id[:], []byte(Hash(match))[:len(id)*2])
+	return id
+}
@@ -0,0 +1,341 @@
+package combind
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+type memoryComponentStorage struct {
+	mu         sync.RWMutex
+	components map[string]BackendComponent
+	observer   Observer
+}
+
+// MemoryComponentStorageConfiguration configures the in-memory ComponentStorage
+type MemoryComponentStorageConfiguration func(*memoryComponentStorage)
+
+// WithMemoryComponentObserver notifies the observer of the components saved
+// in the storage, instead of the observer of the context
+func WithMemoryComponentObserver(observer Observer) MemoryComponentStorageConfiguration {
+	return func(s *memoryComponentStorage) {
+		s.observer = observer
+	}
+}
+
+// NewMemoryComponentStorage creates a thread-safe in-memory ComponentStorage,
+// useful for tests and local runs without an Elasticsearch cluster
+func NewMemoryComponentStorage(c ...*BackendComponent) ComponentStorage {
+	return NewMemoryComponentStorageWithConfiguration(c)
+}
+
+// NewMemoryComponentStorageWithConfiguration creates an in-memory
+// ComponentStorage holding the components, configured with cfg
+func NewMemoryComponentStorageWithConfiguration(c []*BackendComponent, cfg ...MemoryComponentStorageConfiguration) ComponentStorage {
+	s := &memoryComponentStorage{
+		components: map[string]BackendComponent{},
+	}
+
+	for _, d := range c {
+		s.components[componentID(d)] = copyBackendComponent(d)
+	}
+
+	for _, c := range cfg {
+		c(s)
+	}
+
+	return s
+}
+
+func (s *memoryComponentStorage) Find(ctx context.Context, componentType string) ([]BackendComponent, error) {
+	return s.Search(ctx, componentType, SearchFilter{})
+}
+
+func (s *memoryComponentStorage) Search(ctx context.Context, componentType string, searchFilter SearchFilter) ([]BackendComponent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := []BackendComponent{}
+	ids := []string{}
+	for id := range s.components {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		c := s.components[id]
+		if c.Type == componentType && matchesFilter(c.Props, searchFilter) {
+			results = append(results, copyBackendComponent(&c))
+		}
+	}
+
+	return results, nil
+}
+
+// SearchEach calls fn with a copy of every matching component, without holding the lock while fn runs
+func (s *memoryComponentStorage) SearchEach(ctx context.Context, componentType string, searchFilter SearchFilter, fn func(*BackendComponent) error) error {
+	s.mu.RLock()
+	ids := []string{}
+	for id, c := range s.components {
+		if c.Type == componentType && matchesFilter(c.Props, searchFilter) {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.mu.RLock()
+		c, ok := s.components[id]
+		s.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		c = copyBackendComponent(&c)
+		if err := fn(&c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryComponentStorage) Save(ctx context.Context, c ...*BackendComponent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range c {
+		s.components[componentID(d)] = copyBackendComponent(d)
+	}
+
+	storageObserver(ctx, s.observer).DocumentsIndexed(ctx, memoryIndex, int64(len(c)))
+	return nil
+}
+
+func (s *memoryComponentStorage) Delete(ctx context.Context, c ...*BackendComponent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range c {
+		delete(s.components, componentID(d))
+	}
+
+	return nil
+}
+
+func (s *memoryComponentStorage) FilteredDelete(ctx context.Context, componentType string, searchFilter SearchFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for id, c := range s.components {
+		if c.Type == componentType && matchesFilter(c.Props, searchFilter) {
+			delete(s.components, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// memoryIndex names the in-memory storages towards observers
+const memoryIndex = "memory"
+
+type memorySearchBoxStorage struct {
+	mu        sync.RWMutex
+	documents map[string]SearchBox
+	observer  Observer
+}
+
+// MemorySearchBoxStorageConfiguration configures the in-memory SearchBoxStorage
+type MemorySearchBoxStorageConfiguration func(*memorySearchBoxStorage)
+
+// WithMemoryObserver notifies the observer of the documents saved in the
+// storage, instead of the observer of the context
+func WithMemoryObserver(observer Observer) MemorySearchBoxStorageConfiguration {
+	return func(s *memorySearchBoxStorage) {
+		s.observer = observer
+	}
+}
+
+// NewMemorySearchBoxStorage creates a thread-safe in-memory SearchBoxStorage.
+// Like the Elastic storage it keeps one document per match and every Save
+// replaces the previously saved documents
+func NewMemorySearchBoxStorage(cfg ...MemorySearchBoxStorageConfiguration) SearchBoxStorage {
+	s := &memorySearchBoxStorage{
+		documents: map[string]SearchBox{},
+	}
+
+	for _, c := range cfg {
+		c(s)
+	}
+
+	return s
+}
+
+func (s *memorySearchBoxStorage) Find(ctx context.Context, boxType string) ([]SearchBox, error) {
+	return collectSearchBoxes(ctx, boxType, s.FindEach)
+}
+
+func (s *memorySearchBoxStorage) FindEach(ctx context.Context, boxType string, fn func(*SearchBox) error) error {
+	s.mu.RLock()
+	documents := []SearchBox{}
+	for _, d := range s.documents {
+		if d.Type == boxType {
+			documents = append(documents, d)
+		}
+	}
+	s.mu.RUnlock()
+
+	sortSearchBoxDocuments(documents)
+	grouper := &searchBoxGrouper{fn: fn}
+	for _, d := range documents {
+		if err := grouper.add(d); err != nil {
+			return err
+		}
+	}
+	return grouper.flush()
+}
+
+func (s *memorySearchBoxStorage) Save(ctx context.Context, sb ...*SearchBox) error {
+	return s.SaveEach(ctx, searchBoxSlice(sb))
+}
+
+// SaveEach replaces the documents once source has sent every SearchBox, which
+// are held in memory until then like any Save of the storage
+func (s *memorySearchBoxStorage) SaveEach(ctx context.Context, source SearchBoxSource) error {
+	documents, err := collectSearchBoxDocuments(source, DefaultHashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.documents = documents
+	s.mu.Unlock()
+
+	storageObserver(ctx, s.observer).DocumentsIndexed(ctx, memoryIndex, int64(len(documents)))
+	return nil
+}
+
+func (s *memorySearchBoxStorage) Apply(ctx context.Context, diff BuildDiff) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexed := applyDocuments(s.documents, diff, DefaultHashAlgorithm)
+	storageObserver(ctx, s.observer).DocumentsIndexed(ctx, memoryIndex, indexed)
+	return nil
+}
+
+// collectSearchBoxDocuments splits the boxes sent by source into documents keyed on their id
+func collectSearchBoxDocuments(source SearchBoxSource, algorithm HashAlgorithm) (map[string]SearchBox, error) {
+	documents := map[string]SearchBox{}
+	err := source(func(d *SearchBox) error {
+		for _, doc := range searchBoxDocuments(d, algorithm) {
+			documents[searchBoxDocumentID(&doc)] = doc
+		}
+		return nil
+	})
+	return documents, err
+}
+
+// applyDocuments applies a diff to documents keyed on their id and returns the number of documents written
+func applyDocuments(documents map[string]SearchBox, diff BuildDiff, algorithm HashAlgorithm) int64 {
+	remove := func(d *SearchBox) {
+		for id, doc := range documents {
+			if doc.Type == d.Type && doc.Key == d.Key {
+				delete(documents, id)
+			}
+		}
+	}
+
+	indexed := int64(0)
+	for _, td := range diff {
+		for _, d := range td.Deleted {
+			remove(d)
+		}
+		for _, d := range append(td.Updated, td.Created...) {
+			remove(d)
+			for _, doc := range searchBoxDocuments(d, algorithm) {
+				documents[searchBoxDocumentID(&doc)] = doc
+				indexed++
+			}
+		}
+	}
+	return indexed
+}
+
+func componentID(c *BackendComponent) string {
+	return fmt.Sprintf("%s_%s", c.Type, c.Code)
+}
+
+// sortSearchBoxDocuments sorts documents on type, key and hash, the order FindEach groups them in
+func sortSearchBoxDocuments(documents []SearchBox) {
+	sort.Slice(documents, func(i, j int) bool {
+		a, b := documents[i], documents[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.HashMatch < b.HashMatch
+	})
+}
+
+func searchBoxDocumentID(d *SearchBox) string {
+	return fmt.Sprintf("%s_%s_%s", d.Type, d.Key, d.HashMatch)
+}
+
+// searchBoxDocuments splits a SearchBox into the stored documents, one per match
+func searchBoxDocuments(d *SearchBox, algorithm HashAlgorithm) []SearchBox {
+	documents := make([]SearchBox, 0, len(d.Matches))
+	for _, key := range d.Matches {
+		dCopy := *d
+		dCopy.HashMatch = HashWith(algorithm, key)
+		dCopy.HashVersion = algorithm
+		dCopy.Match = key
+		dCopy.Matches = []Key{}
+		dCopy.Props = Merge(d.Props, nil)
+		dCopy.Provenance = nil
+		dCopy.MatchProvenance = d.Provenance[Hash(key)]
+		documents = append(documents, dCopy)
+	}
+	return documents
+}
+
+func copyBackendComponent(c *BackendComponent) BackendComponent {
+	cCopy := *c
+	if c.Props != nil {
+		cCopy.Props = Merge(c.Props, nil)
+	}
+	return cCopy
+}
+
+// matchesFilter mirrors the keyword term queries used by the Elastic storage,
+// which match a prop holding an array on any of its elements
+func matchesFilter(props map[string]interface{}, searchFilter SearchFilter) bool {
+	for k, v := range searchFilter {
+		pv, ok := props[k]
+		if !ok || !matchesTerm(pv, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesTerm(prop interface{}, term interface{}) bool {
+	values := reflect.ValueOf(prop)
+	if values.Kind() != reflect.Slice && values.Kind() != reflect.Array {
+		return fmt.Sprint(prop) == fmt.Sprint(term)
+	}
+	for i := 0; i < values.Len(); i++ {
+		if matchesTerm(values.Index(i).Interface(), term) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package combind_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryComponentStorageSearch(t *testing.T) {
+	ctx := context.Background()
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Props: map[string]interface{}{"country": "se"}},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Props: map[string]interface{}{"country": "se"}},
+		&combind.BackendComponent{Code: "audi", Type: "brand", Props: map[string]interface{}{"country": "de"}},
+		&combind.BackendComponent{Code: "v70", Type: "model"},
+	)
+
+	all, err := storage.Find(ctx, "brand")
+	assert.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	swedish, err := storage.Search(ctx, "brand", combind.SearchFilter{"country": "se"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"saab", "volvo"}, []string{swedish[0].Code, swedish[1].Code})
+
+	deleted, err := storage.FilteredDelete(ctx, "brand", combind.SearchFilter{"country": "se"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	assert.NoError(t, storage.Delete(ctx, &combind.BackendComponent{Code: "audi", Type: "brand"}))
+	all, err = storage.Find(ctx, "brand")
+	assert.NoError(t, err)
+	assert.Empty(t, all)
+}
+
+func TestMemoryComponentStorageSearchArrayProps(t *testing.T) {
+	ctx := context.Background()
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "v70", Type: "model", Props: map[string]interface{}{"market": []interface{}{"se", "no"}}},
+		&combind.BackendComponent{Code: "xc90", Type: "model", Props: map[string]interface{}{"market": []string{"de"}}},
+		&combind.BackendComponent{Code: "s60", Type: "model", Props: map[string]interface{}{"market": "no"}},
+	)
+
+	norwegian, err := storage.Search(ctx, "model", combind.SearchFilter{"market": "no"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"s60", "v70"}, []string{norwegian[0].Code, norwegian[1].Code})
+
+	german, err := storage.Search(ctx, "model", combind.SearchFilter{"market": "de"})
+	assert.NoError(t, err)
+	if assert.Len(t, german, 1) {
+		assert.Equal(t, "xc90", german[0].Code)
+	}
+
+	deleted, err := storage.FilteredDelete(ctx, "model", combind.SearchFilter{"market": "se"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+}
+
+func TestMemorySearchBoxStorageSaveEndToEnd(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+	boxes := combind.NewMemorySearchBoxStorage()
+
+	g := combind.New(boxes, combind.NewRoot("brand", components))
+	assert.NoError(t, g.Save(ctx))
+
+	found, err := boxes.Find(ctx, "brand")
+	assert.NoError(t, err)
+	assert.Len(t, found, 2)
+	for _, d := range found {
+		assert.Equal(t, []combind.Key{{"brand": d.Key}}, d.Matches)
+		assert.Equal(t, combind.DefaultHashAlgorithm, d.HashVersion)
+	}
+}
+
+func TestMemorySearchBoxStorageApply(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+	boxes := combind.NewMemorySearchBoxStorage()
+
+	g := combind.New(boxes, combind.NewRoot("brand", components))
+	assert.NoError(t, g.Save(ctx))
+
+	audi := &combind.BackendComponent{Code: "audi", Type: "brand", Name: "Audi"}
+	saab := &combind.BackendComponent{Code: "saab", Type: "brand"}
+	assert.NoError(t, components.Save(ctx, audi))
+	assert.NoError(t, components.Delete(ctx, saab))
+
+	diff, err := g.Update(ctx, audi, saab)
+	assert.NoError(t, err)
+	assert.NoError(t, boxes.Apply(ctx, diff))
+
+	found, err := boxes.Find(ctx, "brand")
+	assert.NoError(t, err)
+	keys := []string{}
+	for _, d := range found {
+		keys = append(keys, d.Key)
+	}
+	assert.Equal(t, []string{"audi", "volvo"}, keys)
+}
+
+func TestMemorySearchBoxStorageFindGroupsMatches(t *testing.T) {
+	ctx := context.Background()
+	boxes := combind.NewMemorySearchBoxStorage()
+	assert.NoError(t, boxes.Save(ctx,
+		&combind.SearchBox{Key: "volvo_v70", Type: "cars", Matches: []combind.Key{{"brand": "volvo", "model": "v70"}}},
+		&combind.SearchBox{Key: "volvo", Type: "cars", Matches: []combind.Key{
+			{"brand": "volvo", "model": "xc90"},
+			{"brand": "volvo", "model": "v70"},
+		}},
+		&combind.SearchBox{Key: "saab", Type: "brand", Matches: []combind.Key{{"brand": "saab"}}},
+	))
+
+	found, err := boxes.Find(ctx, "cars")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"volvo", "volvo_v70"}, []string{found[0].Key, found[1].Key})
+	assert.ElementsMatch(t, []combind.Key{
+		{"brand": "volvo", "model": "xc90"},
+		{"brand": "volvo", "model": "v70"},
+	}, found[0].Matches)
+
+	keys := []string{}
+	stop := errors.New("stop")
+	err = boxes.(combind.StreamingSearchBoxStorage).FindEach(ctx, "cars", func(sb *combind.SearchBox) error {
+		keys = append(keys, sb.Key)
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []string{"volvo"}, keys)
+}
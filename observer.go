@@ -0,0 +1,91 @@
+package combind
+
+import (
+	"context"
+	"time"
+)
+
+// Observer is notified of build and indexing events, to record metrics or
+// tracing spans. Embed NopObserver to only implement some of the events.
+// Observers are called concurrently from parallel builds
+type Observer interface {
+	// BuildStarted is called when a component starts building, the returned
+	// context is used for the build, e.g to carry a tracing span
+	BuildStarted(ctx context.Context, componentType string) context.Context
+	// BuildFinished is called when a component build ends, with the number of boxes built
+	BuildFinished(ctx context.Context, componentType string, boxes int, duration time.Duration, err error)
+	// CombinationsProduced is called with the number of combinations a virtual component evaluated
+	CombinationsProduced(ctx context.Context, componentType string, count int64)
+	// RuleMatched is called with the number of combinations a rule matched
+	RuleMatched(ctx context.Context, componentType string, rule string, count int64)
+	// Unmatched is called with the number of combinations no rule matched
+	Unmatched(ctx context.Context, componentType string, count int64)
+	// DocumentsIndexed is called with the number of documents written to an index
+	DocumentsIndexed(ctx context.Context, index string, count int64)
+	// AliasRolled is called when an alias is moved to a new index
+	AliasRolled(ctx context.Context, alias string, index string, previous []string)
+}
+
+// NopObserver ignores every event
+type NopObserver struct{}
+
+func (NopObserver) BuildStarted(ctx context.Context, componentType string) context.Context {
+	return ctx
+}
+
+func (NopObserver) BuildFinished(ctx context.Context, componentType string, boxes int, duration time.Duration, err error) {
+}
+
+func (NopObserver) CombinationsProduced(ctx context.Context, componentType string, count int64) {}
+
+func (NopObserver) RuleMatched(ctx context.Context, componentType string, rule string, count int64) {}
+
+func (NopObserver) Unmatched(ctx context.Context, componentType string, count int64) {}
+
+func (NopObserver) DocumentsIndexed(ctx context.Context, index string, count int64) {}
+
+func (NopObserver) AliasRolled(ctx context.Context, alias string, index string, previous []string) {}
+
+type observerKey struct{}
+
+// ContextWithObserver returns a context notifying the observer, components and
+// storages look up their observer from the context they are called with,
+// unless a storage was created with an observer of its own
+func ContextWithObserver(ctx context.Context, observer Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, observer)
+}
+
+// ObserverFromContext returns the observer of the context, or a NopObserver
+func ObserverFromContext(ctx context.Context) Observer {
+	if observer, ok := ctx.Value(observerKey{}).(Observer); ok && observer != nil {
+		return observer
+	}
+	return NopObserver{}
+}
+
+// storageObserver returns the observer a storage was created with, or else the
+// observer of the context
+func storageObserver(ctx context.Context, observer Observer) Observer {
+	if observer != nil {
+		return observer
+	}
+	return ObserverFromContext(ctx)
+}
+
+// WithObserver notifies the observer of every Save, Update and build of the graph
+func WithObserver(observer Observer) CombindConfiguration {
+	return func(g *Combind) {
+		g.observer = observer
+	}
+}
+
+// observe starts observing a build, returning the context to build with and a
+// func to call with the result
+func observe(ctx context.Context, componentType string) (context.Context, func(boxes int, err error)) {
+	observer := ObserverFromContext(ctx)
+	start := time.Now()
+	ctx = observer.BuildStarted(ctx, componentType)
+	return ctx, func(boxes int, err error) {
+		observer.BuildFinished(ctx, componentType, boxes, time.Since(start), err)
+	}
+}
@@ -0,0 +1,107 @@
+package combind_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingObserver struct {
+	combind.NopObserver
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) add(format string, args ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) BuildStarted(ctx context.Context, componentType string) context.Context {
+	o.add("started %s", componentType)
+	return ctx
+}
+
+func (o *recordingObserver) BuildFinished(ctx context.Context, componentType string, boxes int, duration time.Duration, err error) {
+	o.add("finished %s %d %v", componentType, boxes, err)
+}
+
+func (o *recordingObserver) CombinationsProduced(ctx context.Context, componentType string, count int64) {
+	o.add("combinations %s %d", componentType, count)
+}
+
+func (o *recordingObserver) RuleMatched(ctx context.Context, componentType string, rule string, count int64) {
+	o.add("rule %s %s %d", componentType, rule, count)
+}
+
+func (o *recordingObserver) Unmatched(ctx context.Context, componentType string, count int64) {
+	o.add("unmatched %s %d", componentType, count)
+}
+
+func (o *recordingObserver) DocumentsIndexed(ctx context.Context, index string, count int64) {
+	o.add("indexed %s %d", index, count)
+}
+
+func TestObserverIsNotifiedOfSave(t *testing.T) {
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand"},
+		&combind.BackendComponent{Code: "red", Type: "color"},
+		&combind.BackendComponent{Code: "blue", Type: "color"},
+	)
+	vc := combind.NewVirtualComponent("brand-color", nil, combind.WithContextCombiner(combind.JoinCombiner()),
+		combind.WithDependency(combind.NewRoot("brand", storage), combind.NewRoot("color", storage)),
+		combind.WithNamedRule("red-cars", func(c *combind.Combination) (*combind.SearchBox, bool) {
+			if c.Types["color"].Key != "red" {
+				return nil, false
+			}
+			return &combind.SearchBox{Key: "red", Type: "brand-color", Matches: c.Matches}, true
+		}),
+	)
+
+	observer := &recordingObserver{}
+	g, err := combind.NewWithConfiguration(combind.NewMemorySearchBoxStorage(), []combind.Component{vc}, combind.WithObserver(observer))
+	assert.NoError(t, err)
+	assert.NoError(t, g.Save(context.Background()))
+
+	sort.Strings(observer.events)
+	assert.Equal(t, []string{
+		"combinations brand-color 2",
+		"finished Graph 2 <nil>",
+		"finished brand 1 <nil>",
+		"finished brand-color 2 <nil>",
+		"finished color 2 <nil>",
+		"indexed memory 2",
+		"rule brand-color red-cars 1",
+		"started Graph",
+		"started brand",
+		"started brand-color",
+		"started color",
+		"unmatched brand-color 1",
+	}, observer.events)
+}
+
+func TestStorageObserverTakesPrecedenceOverContext(t *testing.T) {
+	contextObserver := &recordingObserver{}
+	ctx := combind.ContextWithObserver(context.Background(), contextObserver)
+
+	observer := &recordingObserver{}
+	components := combind.NewMemoryComponentStorageWithConfiguration(nil, combind.WithMemoryComponentObserver(observer))
+	assert.NoError(t, components.Save(ctx, &combind.BackendComponent{Code: "volvo", Type: "brand"}))
+
+	boxes := combind.NewMemorySearchBoxStorage(combind.WithMemoryObserver(observer))
+	assert.NoError(t, boxes.Save(ctx, &combind.SearchBox{Key: "volvo", Type: "brand", Matches: []combind.Key{{"brand": "volvo"}}}))
+
+	files := combind.NewFileSearchBoxStorage(t.TempDir(), "boxes", combind.WithFileObserver(observer))
+	assert.NoError(t, files.Save(ctx, &combind.SearchBox{Key: "volvo", Type: "brand", Matches: []combind.Key{{"brand": "volvo"}}}))
+
+	assert.Empty(t, contextObserver.events)
+	assert.Len(t, observer.events, 3)
+	assert.Equal(t, []string{"indexed memory 1", "indexed memory 1"}, observer.events[:2])
+}
@@ -0,0 +1,169 @@
+package combind
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Plan reports what a Save would change in storage, per component type
+type Plan struct {
+	Types []*TypePlan `json:"types"`
+}
+
+// TypePlan holds the boxes of one component type that would be created,
+// changed or removed, and the total number of matches created and removed
+type TypePlan struct {
+	Type           string       `json:"type"`
+	Created        []*BoxChange `json:"created"`
+	Changed        []*BoxChange `json:"changed"`
+	Removed        []*BoxChange `json:"removed"`
+	MatchesCreated int          `json:"matches_created"`
+	MatchesRemoved int          `json:"matches_removed"`
+}
+
+// BoxChange describes the change of a single SearchBox
+type BoxChange struct {
+	Key            string `json:"key"`
+	PropsChanged   bool   `json:"props_changed,omitempty"`
+	MatchesCreated []Key  `json:"matches_created,omitempty"`
+	MatchesRemoved []Key  `json:"matches_removed,omitempty"`
+}
+
+// Plan builds every component and compares the result with the SearchBoxes
+// currently in storage, without writing anything
+func (g *Combind) Plan(ctx context.Context) (*Plan, error) {
+	ctx, done := observe(g.observed(ctx), g.Name())
+	results, err := g.buildTypes(ctx)
+	boxes := []*SearchBox{}
+	for _, r := range results {
+		boxes = append(boxes, r...)
+	}
+	done(len(boxes), err)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Types: []*TypePlan{},
+	}
+	for _, typ := range g.sortedTypes() {
+		existing, err := g.searchStorage.Find(ctx, typ)
+		if err != nil {
+			return nil, err
+		}
+		plan.Types = append(plan.Types, planType(typ, searchBoxPointers(existing), results[typ]))
+	}
+
+	return plan, nil
+}
+
+// Empty reports whether a Save would change nothing
+func (p *Plan) Empty() bool {
+	for _, tp := range p.Types {
+		if len(tp.Created)+len(tp.Changed)+len(tp.Removed) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// JSON renders the plan as indented JSON
+func (p *Plan) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// Text renders the plan as a human readable summary, one line per changed box
+func (p *Plan) Text() string {
+	sb := &strings.Builder{}
+	for _, tp := range p.Types {
+		fmt.Fprintf(sb, "%s: %d created, %d changed, %d removed boxes, %d created, %d removed matches\n",
+			tp.Type, len(tp.Created), len(tp.Changed), len(tp.Removed), tp.MatchesCreated, tp.MatchesRemoved)
+		for _, c := range tp.Created {
+			fmt.Fprintf(sb, "  + %s (%d matches)\n", c.Key, len(c.MatchesCreated))
+		}
+		for _, c := range tp.Changed {
+			props := ""
+			if c.PropsChanged {
+				props = "props, "
+			}
+			fmt.Fprintf(sb, "  ~ %s (%s+%d -%d matches)\n", c.Key, props, len(c.MatchesCreated), len(c.MatchesRemoved))
+		}
+		for _, c := range tp.Removed {
+			fmt.Fprintf(sb, "  - %s (%d matches)\n", c.Key, len(c.MatchesRemoved))
+		}
+	}
+	return sb.String()
+}
+
+func planType(typ string, existing []*SearchBox, built []*SearchBox) *TypePlan {
+	diff := diffSearchBoxes(existing, built)
+	tp := &TypePlan{
+		Type:    typ,
+		Created: []*BoxChange{},
+		Changed: []*BoxChange{},
+		Removed: []*BoxChange{},
+	}
+
+	existingIndex := map[string]*SearchBox{}
+	for _, sb := range existing {
+		existingIndex[sb.Key] = sb
+	}
+
+	for _, sb := range diff.Created {
+		tp.Created = append(tp.Created, &BoxChange{
+			Key:            sb.Key,
+			MatchesCreated: sortedMatches(matchDifference(sb.Matches, nil)),
+		})
+	}
+	for _, sb := range diff.Updated {
+		previous := existingIndex[sb.Key]
+		tp.Changed = append(tp.Changed, &BoxChange{
+			Key:            sb.Key,
+			PropsChanged:   !sameProps(previous.Props, sb.Props),
+			MatchesCreated: sortedMatches(matchDifference(sb.Matches, previous.Matches)),
+			MatchesRemoved: sortedMatches(matchDifference(previous.Matches, sb.Matches)),
+		})
+	}
+	for _, sb := range diff.Deleted {
+		tp.Removed = append(tp.Removed, &BoxChange{
+			Key:            sb.Key,
+			MatchesRemoved: sortedMatches(matchDifference(sb.Matches, nil)),
+		})
+	}
+
+	for _, c := range append(append(tp.Created, tp.Changed...), tp.Removed...) {
+		tp.MatchesCreated += len(c.MatchesCreated)
+		tp.MatchesRemoved += len(c.MatchesRemoved)
+	}
+
+	return tp
+}
+
+// matchDifference returns the distinct matches of a that are not in b, compared on their hash
+func matchDifference(a []Key, b []Key) []Key {
+	exclude := map[string]bool{}
+	for _, m := range b {
+		exclude[Hash(m)] = true
+	}
+
+	result := []Key{}
+	for _, m := range a {
+		h := Hash(m)
+		if exclude[h] {
+			continue
+		}
+		exclude[h] = true
+		result = append(result, m)
+	}
+	return result
+}
+
+func sortedMatches(matches []Key) []Key {
+	sort.Slice(matches, func(i, j int) bool {
+		return CanonicalKey(matches[i]) < CanonicalKey(matches[j])
+	})
+	return matches
+}
@@ -0,0 +1,60 @@
+package combind_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanReportsChangesWithoutWriting(t *testing.T) {
+	ctx := context.Background()
+	components := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+	boxes := combind.NewMemorySearchBoxStorage()
+
+	g := combind.New(boxes, combind.NewRoot("brand", components))
+	assert.NoError(t, g.Save(ctx))
+
+	plan, err := g.Plan(ctx)
+	assert.NoError(t, err)
+	assert.True(t, plan.Empty())
+
+	assert.NoError(t, components.Save(ctx,
+		&combind.BackendComponent{Code: "audi", Type: "brand", Name: "Audi"},
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo Cars"},
+	))
+	assert.NoError(t, components.Delete(ctx, &combind.BackendComponent{Code: "saab", Type: "brand"}))
+
+	plan, err = g.Plan(ctx)
+	assert.NoError(t, err)
+	assert.False(t, plan.Empty())
+
+	brands := plan.Types[0]
+	assert.Equal(t, "brand", brands.Type)
+	assert.Equal(t, []*combind.BoxChange{{Key: "audi", MatchesCreated: []combind.Key{{"brand": "audi"}}}}, brands.Created)
+	assert.Equal(t, []*combind.BoxChange{{Key: "volvo", PropsChanged: true, MatchesCreated: []combind.Key{}, MatchesRemoved: []combind.Key{}}}, brands.Changed)
+	assert.Equal(t, []*combind.BoxChange{{Key: "saab", MatchesRemoved: []combind.Key{{"brand": "saab"}}}}, brands.Removed)
+	assert.Equal(t, 1, brands.MatchesCreated)
+	assert.Equal(t, 1, brands.MatchesRemoved)
+
+	assert.Equal(t, "brand: 1 created, 1 changed, 1 removed boxes, 1 created, 1 removed matches\n"+
+		"  + audi (1 matches)\n"+
+		"  ~ volvo (props, +0 -0 matches)\n"+
+		"  - saab (1 matches)\n", plan.Text())
+
+	data, err := plan.JSON()
+	assert.NoError(t, err)
+	decoded := &combind.Plan{}
+	assert.NoError(t, json.Unmarshal(data, decoded))
+	assert.Len(t, decoded.Types, 1)
+	assert.Equal(t, "audi", decoded.Types[0].Created[0].Key)
+
+	found, err := boxes.Find(ctx, "brand")
+	assert.NoError(t, err)
+	assert.Len(t, found, 2)
+}
@@ -0,0 +1,146 @@
+package combind
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NoMappingRuleName identifies the no mapping rule in provenance records
+const NoMappingRuleName = "no-mapping"
+
+// Provenance records the rule that produced a match and the keys of the
+// dependency boxes of the combination it came from
+type Provenance struct {
+	Rule    string            `json:"rule"`
+	Sources map[string]string `json:"sources"`
+}
+
+// WithProvenance makes the provenance of every match available, see VirtualComponent.Provenance
+func WithProvenance() VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		if vc.provenance == nil {
+			vc.provenance = &provenanceRecorder{
+				records: map[string]map[string][]Provenance{},
+			}
+		}
+	}
+}
+
+// WithProvenanceInDocuments makes provenance available and attaches it to the
+// built boxes, so that storages write it to every match document
+func WithProvenanceInDocuments() VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		WithProvenance()(vc)
+		vc.provenance.inDocuments = true
+	}
+}
+
+// Provenance returns how a match of a box of the last build was produced, or
+// nil when provenance is not recorded
+func (vc *VirtualComponent) Provenance(boxKey string, match Key) []Provenance {
+	if vc.provenance == nil {
+		return nil
+	}
+
+	vc.provenance.mu.RLock()
+	defer vc.provenance.mu.RUnlock()
+
+	return vc.provenance.records[boxKey][Hash(match)]
+}
+
+// provenanceRecorder holds provenance per box key and match hash. A nil
+// recorder records nothing
+type provenanceRecorder struct {
+	mu          sync.RWMutex
+	inDocuments bool
+	records     map[string]map[string][]Provenance
+}
+
+func (p *provenanceRecorder) reset() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.records = map[string]map[string][]Provenance{}
+}
+
+func (p *provenanceRecorder) record(boxKey string, rule string, combination *Combination, matches []Key) {
+	if p == nil {
+		return
+	}
+
+	sources := map[string]string{}
+	for typ, sb := range combination.Types {
+		sources[typ] = sb.Key
+	}
+	record := Provenance{
+		Rule:    rule,
+		Sources: sources,
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.records[boxKey]; !ok {
+		p.records[boxKey] = map[string][]Provenance{}
+	}
+	for _, m := range matches {
+		h := Hash(m)
+		if !containsProvenance(p.records[boxKey][h], record) {
+			p.records[boxKey][h] = append(p.records[boxKey][h], record)
+		}
+	}
+}
+
+// prune drops the records of matches no longer built and attaches the
+// remaining ones to the boxes when asked to
+func (p *provenanceRecorder) prune(boxes []*SearchBox) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	records := map[string]map[string][]Provenance{}
+	for _, sb := range boxes {
+		boxRecords := map[string][]Provenance{}
+		for _, m := range sb.Matches {
+			h := Hash(m)
+			if r, ok := p.records[sb.Key][h]; ok {
+				sort.Slice(r, func(i, j int) bool {
+					return provenanceSignature(r[i]) < provenanceSignature(r[j])
+				})
+				boxRecords[h] = r
+			}
+		}
+		records[sb.Key] = boxRecords
+		if p.inDocuments {
+			sb.Provenance = boxRecords
+		}
+	}
+	p.records = records
+}
+
+func containsProvenance(records []Provenance, record Provenance) bool {
+	signature := provenanceSignature(record)
+	for _, r := range records {
+		if provenanceSignature(r) == signature {
+			return true
+		}
+	}
+	return false
+}
+
+func provenanceSignature(p Provenance) string {
+	sources := []string{}
+	for typ, key := range p.Sources {
+		sources = append(sources, CanonicalKey(Key{typ: key}))
+	}
+	sort.Strings(sources)
+	return p.Rule + "|" + strings.Join(sources, "")
+}
@@ -0,0 +1,64 @@
+package combind_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvenanceRecordsRuleAndSources(t *testing.T) {
+	ctx := context.Background()
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand"},
+		&combind.BackendComponent{Code: "red", Type: "color"},
+		&combind.BackendComponent{Code: "blue", Type: "color"},
+	)
+
+	vc := combind.NewVirtualComponent("brand-color", nil, combind.WithContextCombiner(combind.JoinCombiner()),
+		combind.WithDependency(combind.NewRoot("brand", storage), combind.NewRoot("color", storage)),
+		combind.WithNamedRule("red-cars", func(c *combind.Combination) (*combind.SearchBox, bool) {
+			if c.Types["color"].Key != "red" {
+				return nil, false
+			}
+			return &combind.SearchBox{Key: "red", Type: "brand-color", Matches: c.Matches}, true
+		}),
+		combind.WithProvenanceInDocuments(),
+	)
+
+	boxes := combind.NewMemorySearchBoxStorage()
+	g := combind.New(boxes, vc)
+	assert.NoError(t, g.Save(ctx))
+
+	red := combind.Key{"brand": "volvo", "color": "red"}
+	assert.Equal(t, []combind.Provenance{
+		{Rule: "red-cars", Sources: map[string]string{"brand": "volvo", "color": "red"}},
+	}, vc.Provenance("red", red))
+
+	blue := combind.Key{"brand": "volvo", "color": "blue"}
+	assert.Equal(t, []combind.Provenance{
+		{Rule: combind.NoMappingRuleName, Sources: map[string]string{"brand": "volvo", "color": "blue"}},
+	}, vc.Provenance("not-mapped", blue))
+	assert.Nil(t, vc.Provenance("red", blue))
+
+	documents, err := boxes.Find(ctx, "brand-color")
+	assert.NoError(t, err)
+	assert.Len(t, documents, 2)
+	for _, d := range documents {
+		assert.Equal(t, vc.Provenance(d.Key, d.Match), d.MatchProvenance)
+	}
+}
+
+func TestProvenanceIsOptional(t *testing.T) {
+	ctx := context.Background()
+	storage := combind.NewMemoryComponentStorage(&combind.BackendComponent{Code: "volvo", Type: "brand"})
+	vc := combind.NewVirtualComponent("brands", nil, combind.WithContextCombiner(combind.JoinCombiner()),
+		combind.WithDependency(combind.NewRoot("brand", storage)),
+	)
+
+	built, err := vc.Build(ctx, true)
+	assert.NoError(t, err)
+	assert.Nil(t, built[0].Provenance)
+	assert.Nil(t, vc.Provenance("not-mapped", combind.Key{"brand": "volvo"}))
+}
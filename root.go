@@ -92,6 +92,32 @@ func (rc *RootComponent) Build(ctx context.Context, rebuild bool) ([]*SearchBox,
 		return rc.build, nil
 	}
 
+	ctx, done := observe(ctx, rc.typ)
+	result, err := rc.search(ctx)
+	done(len(result), err)
+	return result, err
+}
+
+// BuildEach sends a box for every backend component of the type to fn, as the
+// components are read from a StreamingComponentStorage. Other storages are
+// read with a single Search, only the boxes are then built one at a time.
+// Result modifiers need the whole build, with any of them the boxes are sent
+// once built
+func (rc *RootComponent) BuildEach(ctx context.Context, fn func(*SearchBox) error) error {
+	rc.build = nil
+
+	ctx, done := observe(ctx, rc.typ)
+	boxes := 0
+	err := rc.searchEach(ctx, func(sb *SearchBox) error {
+		boxes++
+		return fn(sb)
+	})
+	done(boxes, err)
+	return err
+}
+
+// search builds a box for every backend component of the type
+func (rc *RootComponent) search(ctx context.Context) ([]*SearchBox, error) {
 	values, err := rc.storage.Search(ctx, rc.typ, rc.searchFilter)
 	if err != nil {
 		return nil, err
@@ -100,43 +126,80 @@ func (rc *RootComponent) Build(ctx context.Context, rebuild bool) ([]*SearchBox,
 	addOrUpdate := []*SearchBox{}
 
 	for _, value := range values {
-		k := Key{}
-
-		b, err := json.Marshal(map[string]string{
-			rc.KeyType: value.Code,
-		})
+		addOrUpdate = append(addOrUpdate, rc.box(value))
+	}
+	rc.build = addOrUpdate
+	for _, rm := range rc.resultModifiers {
+		rm(rc.build)
+	}
+	return rc.build, nil
+}
 
+func (rc *RootComponent) searchEach(ctx context.Context, fn func(*SearchBox) error) error {
+	if len(rc.resultModifiers) > 0 {
+		boxes, err := rc.search(ctx)
+		rc.build = nil
 		if err != nil {
-			log.Fatalf("Could not marshal %v", rc.typ)
+			return err
 		}
+		return searchBoxSlice(boxes)(fn)
+	}
 
-		if err := json.Unmarshal(b, &k); err != nil {
-			log.Fatalf("Could not unmarshal %s", b)
-		}
+	if storage, ok := rc.storage.(StreamingComponentStorage); ok {
+		return storage.SearchEach(ctx, rc.typ, rc.searchFilter, func(value *BackendComponent) error {
+			return fn(rc.box(*value))
+		})
+	}
 
-		sb := &SearchBox{
-			Type: rc.typ,
-			Key:  value.Code,
-			Props: merge(map[string]interface{}{
-				"name": value.Name,
-			}, value.Props),
-			Matches: []Key{k},
+	values, err := rc.storage.Search(ctx, rc.typ, rc.searchFilter)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		if err := fn(rc.box(value)); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		for _, modifier := range rc.modifiers {
-			modifier(sb)
-		}
+// box builds the box of a backend component
+func (rc *RootComponent) box(value BackendComponent) *SearchBox {
+	k := Key{}
 
-		addOrUpdate = append(addOrUpdate, sb)
+	b, err := json.Marshal(map[string]string{
+		rc.KeyType: value.Code,
+	})
+
+	if err != nil {
+		log.Fatalf("Could not marshal %v", rc.typ)
 	}
-	for _, c := range addOrUpdate {
-		c.Matches = DedupKeys(c.Matches)
+
+	if err := json.Unmarshal(b, &k); err != nil {
+		log.Fatalf("Could not unmarshal %s", b)
 	}
-	rc.build = addOrUpdate
-	for _, rm := range rc.resultModifiers {
-		rm(rc.build)
+
+	sb := &SearchBox{
+		Type: rc.typ,
+		Key:  value.Code,
+		Props: merge(map[string]interface{}{
+			"name": value.Name,
+		}, value.Props),
+		Matches: []Key{k},
 	}
-	return rc.build, nil
+
+	for _, modifier := range rc.modifiers {
+		modifier(sb)
+	}
+	sb.Matches = DedupKeys(sb.Matches)
+
+	return sb
+}
+
+// BuildIncremental rebuilds the root when any of its codes changed
+func (rc *RootComponent) BuildIncremental(ctx context.Context, changes Changes) ([]*SearchBox, error) {
+	_, changed := changes[rc.typ]
+	return rc.Build(ctx, changed)
 }
 
 func (rc *RootComponent) BuildQuery(builder *reveald.QueryBuilder) {
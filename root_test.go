@@ -0,0 +1,38 @@
+package combind_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// searchEachStorage fails a Search, reading every component at once
+type searchEachStorage struct {
+	combind.StreamingComponentStorage
+}
+
+func (s searchEachStorage) Search(ctx context.Context, componentType string, searchFilter combind.SearchFilter) ([]combind.BackendComponent, error) {
+	return nil, errors.New("search reads every component")
+}
+
+func TestRootBuildEachSearchesEachComponent(t *testing.T) {
+	ctx := context.Background()
+	storage := searchEachStorage{combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Props: map[string]interface{}{"country": "se"}},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Props: map[string]interface{}{"country": "se"}},
+		&combind.BackendComponent{Code: "audi", Type: "brand", Props: map[string]interface{}{"country": "de"}},
+	).(combind.StreamingComponentStorage)}
+
+	root := combind.NewRoot("brand", storage, combind.WithSearchFilter(combind.SearchFilter{"country": "se"}))
+	keys := []string{}
+	err := root.BuildEach(ctx, func(sb *combind.SearchBox) error {
+		keys = append(keys, sb.Key)
+		assert.Equal(t, []combind.Key{{"brand": sb.Key}}, sb.Matches)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"saab", "volvo"}, keys)
+}
@@ -0,0 +1,346 @@
+package combind
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleDefinitions is a declarative set of rules, loaded from YAML or JSON:
+//
+//	rules:
+//	  - name: volvo-models
+//	    priority: 10
+//	    when:
+//	      - type: brand
+//	        keys: [volvo]
+//	      - type: model
+//	        props:
+//	          brand: volvo
+//	    output:
+//	      key: "{brand.key}-{model.key}"
+//	      props:
+//	        name: "{brand.props.name} {model.props.name}"
+//	        year: "{model.props.year}"
+//	      matches: [brand, model]
+//
+// Conditions hold when the combination contains a box of the type, with one
+// of the keys and props equal to the given values. Output strings are
+// templates where {type.key}, {type.type} and {type.props.name} are replaced
+// with values of the combined boxes, a prop consisting of a single
+// placeholder keeps the type of the value. A rule referencing a missing
+// value does not match. Every rule needs at least one condition and unknown
+// fields are rejected. Matches projects every match on the given fields,
+// all fields are kept when empty. The output type defaults to the type of the
+// virtual component and the priority is used with ConflictHighestPriority
+type RuleDefinitions struct {
+	Definitions []*RuleDefinition `yaml:"rules" json:"rules"`
+}
+
+// RuleDefinition is a single declarative rule
+type RuleDefinition struct {
+	Name     string          `yaml:"name" json:"name"`
+	Priority int             `yaml:"priority" json:"priority"`
+	When     []RuleCondition `yaml:"when" json:"when"`
+	Output   RuleOutput      `yaml:"output" json:"output"`
+
+	rule Rule
+}
+
+// RuleCondition is a condition on one of the boxes of a combination
+type RuleCondition struct {
+	Type  string                 `yaml:"type" json:"type"`
+	Keys  []string               `yaml:"keys" json:"keys"`
+	Props map[string]interface{} `yaml:"props" json:"props"`
+}
+
+// RuleOutput is the template of the SearchBox a rule produces
+type RuleOutput struct {
+	Type    string                 `yaml:"type" json:"type"`
+	Key     string                 `yaml:"key" json:"key"`
+	Props   map[string]interface{} `yaml:"props" json:"props"`
+	Matches []string               `yaml:"matches" json:"matches"`
+}
+
+// ParseRuleDefinitions parses and compiles YAML or JSON rule definitions
+func ParseRuleDefinitions(data []byte) (*RuleDefinitions, error) {
+	defs := &RuleDefinitions{}
+	// unknown fields are rejected, a misspelled field would otherwise drop the
+	// conditions of a rule and map every combination
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(defs); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not parse rule definitions: %w", err)
+	}
+
+	for i, d := range defs.Definitions {
+		if d.Name == "" {
+			d.Name = fmt.Sprintf("rule-%d", i)
+		}
+		rule, err := d.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", d.Name, err)
+		}
+		d.rule = rule
+	}
+
+	return defs, nil
+}
+
+// LoadRuleDefinitions reads rule definitions from a YAML or JSON file
+func LoadRuleDefinitions(path string) (*RuleDefinitions, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRuleDefinitions(data)
+}
+
+// Rules returns the compiled rules, in definition order, producing boxes of
+// componentType when their output has no type. Priorities are only applied
+// WithRuleDefinitions
+func (defs *RuleDefinitions) Rules(componentType string) []Rule {
+	rules := []Rule{}
+	for _, d := range defs.Definitions {
+		rules = append(rules, d.typed(componentType))
+	}
+	return rules
+}
+
+// Types returns the dependency types referenced by the rules
+func (defs *RuleDefinitions) Types() []string {
+	seen := map[string]bool{}
+	for _, d := range defs.Definitions {
+		for _, c := range d.When {
+			seen[c.Type] = true
+		}
+		for _, t := range d.Output.templates() {
+			for _, p := range t.placeholders {
+				seen[p.typ] = true
+			}
+		}
+	}
+
+	types := []string{}
+	for typ := range seen {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// WithRuleDefinitions adds the compiled rule definitions to the component and
+// declares their types, see WithRuleTypes
+func WithRuleDefinitions(defs *RuleDefinitions) VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		for _, d := range defs.Definitions {
+			WithPriorityRule(d.Name, d.Priority, d.typed(vc.typ))(vc)
+		}
+		WithRuleTypes(defs.Types()...)(vc)
+	}
+}
+
+// typed returns the rule producing boxes of componentType when the output has no type
+func (d *RuleDefinition) typed(componentType string) Rule {
+	rule := d.rule
+	return func(combination *Combination) (*SearchBox, bool) {
+		sb, ok := rule(combination)
+		if ok && sb.Type == "" {
+			sb.Type = componentType
+		}
+		return sb, ok
+	}
+}
+
+func (d *RuleDefinition) compile() (Rule, error) {
+	if len(d.When) == 0 {
+		return nil, fmt.Errorf("rule without conditions")
+	}
+	for _, c := range d.When {
+		if c.Type == "" {
+			return nil, fmt.Errorf("condition without type")
+		}
+	}
+	if d.Output.Key == "" {
+		return nil, fmt.Errorf("output without key")
+	}
+
+	key, err := parseRuleTemplate(d.Output.Key)
+	if err != nil {
+		return nil, err
+	}
+	props := map[string]*ruleTemplate{}
+	for name, v := range d.Output.Props {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if props[name], err = parseRuleTemplate(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(combination *Combination) (*SearchBox, bool) {
+		for _, c := range d.When {
+			if !c.holds(combination) {
+				return nil, false
+			}
+		}
+
+		k, ok := key.render(combination)
+		if !ok {
+			return nil, false
+		}
+
+		sb := &SearchBox{
+			Key:     fmt.Sprint(k),
+			Type:    d.Output.Type,
+			Props:   map[string]interface{}{},
+			Matches: projectMatches(combination.Matches, d.Output.Matches),
+		}
+		for name, v := range d.Output.Props {
+			if t, ok := props[name]; ok {
+				if sb.Props[name], ok = t.render(combination); !ok {
+					return nil, false
+				}
+			} else {
+				sb.Props[name] = v
+			}
+		}
+
+		return sb, true
+	}, nil
+}
+
+func (c RuleCondition) holds(combination *Combination) bool {
+	sb, ok := combination.Types[c.Type]
+	if !ok {
+		return false
+	}
+
+	if len(c.Keys) > 0 {
+		found := false
+		for _, k := range c.Keys {
+			if sb.Key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return matchesFilter(sb.Props, c.Props)
+}
+
+func (o RuleOutput) templates() []*ruleTemplate {
+	templates := []*ruleTemplate{}
+	if t, err := parseRuleTemplate(o.Key); err == nil {
+		templates = append(templates, t)
+	}
+	for _, v := range o.Props {
+		if s, ok := v.(string); ok {
+			if t, err := parseRuleTemplate(s); err == nil {
+				templates = append(templates, t)
+			}
+		}
+	}
+	return templates
+}
+
+func projectMatches(matches []Key, fields []string) []Key {
+	if len(fields) == 0 {
+		return matches
+	}
+
+	projected := []Key{}
+	for _, m := range matches {
+		p := Key{}
+		for _, f := range fields {
+			if v, ok := m[f]; ok {
+				p[f] = v
+			}
+		}
+		projected = append(projected, p)
+	}
+	return DedupKeys(projected)
+}
+
+type rulePlaceholder struct {
+	typ  string
+	path []string
+}
+
+// ruleTemplate is a string with {type.key}, {type.type} and {type.props.name} placeholders
+type ruleTemplate struct {
+	literals     []string
+	placeholders []rulePlaceholder
+}
+
+func parseRuleTemplate(s string) (*ruleTemplate, error) {
+	t := &ruleTemplate{}
+	rest := s
+	for {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			t.literals = append(t.literals, rest)
+			return t, nil
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in %q", s)
+		}
+
+		parts := strings.Split(rest[start+1:start+end], ".")
+		valid := len(parts) == 2 && (parts[1] == "key" || parts[1] == "type") ||
+			len(parts) == 3 && parts[1] == "props"
+		if !valid || parts[0] == "" {
+			return nil, fmt.Errorf("invalid placeholder %q in %q", rest[start:start+end+1], s)
+		}
+
+		t.literals = append(t.literals, rest[:start])
+		t.placeholders = append(t.placeholders, rulePlaceholder{typ: parts[0], path: parts[1:]})
+		rest = rest[start+end+1:]
+	}
+}
+
+// render fills in the template, keeping the value as is when the template is a single placeholder
+func (t *ruleTemplate) render(combination *Combination) (interface{}, bool) {
+	values := []interface{}{}
+	for _, p := range t.placeholders {
+		sb, ok := combination.Types[p.typ]
+		if !ok {
+			return nil, false
+		}
+		var v interface{}
+		switch p.path[0] {
+		case "key":
+			v = sb.Key
+		case "type":
+			v = sb.Type
+		default:
+			if v, ok = sb.Props[p.path[1]]; !ok {
+				return nil, false
+			}
+		}
+		values = append(values, v)
+	}
+
+	if len(values) == 1 && t.literals[0] == "" && t.literals[1] == "" {
+		return values[0], true
+	}
+
+	sb := &strings.Builder{}
+	for i, v := range values {
+		sb.WriteString(t.literals[i])
+		sb.WriteString(fmt.Sprint(v))
+	}
+	sb.WriteString(t.literals[len(values)])
+	return sb.String(), true
+}
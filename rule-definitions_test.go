@@ -0,0 +1,118 @@
+package combind_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadRuleDefinitions(t *testing.T) {
+	ctx := context.Background()
+	defs, err := combind.LoadRuleDefinitions("testdata/rules.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"brand", "model"}, defs.Types())
+
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+		&combind.BackendComponent{Code: "v70", Type: "model", Name: "V70", Props: map[string]interface{}{"brand": "volvo", "year": 2020}},
+		&combind.BackendComponent{Code: "9-5", Type: "model", Name: "9-5", Props: map[string]interface{}{"brand": "saab", "year": 2010}},
+	)
+	brand := combind.NewRoot("brand", storage)
+	model := combind.NewRoot("model", storage)
+	market := combind.NewRoot("market", storage)
+	_ = storage.Save(ctx, &combind.BackendComponent{Code: "se", Type: "market"})
+
+	vc := combind.NewVirtualComponent("brand-model", nil, combind.WithContextCombiner(combind.JoinCombiner()),
+		combind.WithDependency(brand, model, market),
+		combind.WithRuleDefinitions(defs),
+	)
+	assert.NoError(t, combind.Validate(vc))
+
+	boxes, err := vc.Build(ctx, true)
+	assert.NoError(t, err)
+
+	byKey := map[string]*combind.SearchBox{}
+	for _, sb := range boxes {
+		byKey[sb.Key] = sb
+	}
+	assert.Len(t, byKey, 2)
+	assert.Equal(t, &combind.SearchBox{
+		Key:  "volvo-v70",
+		Type: "brand-model",
+		Props: map[string]interface{}{
+			"name":   "Volvo V70",
+			"year":   2020,
+			"source": "merchandising",
+		},
+		Matches: []combind.Key{{"brand": "volvo", "model": "v70"}},
+	}, byKey["volvo-v70"])
+	assert.Contains(t, byKey, "not-mapped")
+}
+
+func TestParseRuleDefinitionsJSON(t *testing.T) {
+	defs, err := combind.ParseRuleDefinitions([]byte(`{"rules": [{"when": [{"type": "brand"}], "output": {"type": "brands", "key": "{brand.key}"}}]}`))
+	assert.NoError(t, err)
+
+	rules := defs.Rules("brand-model")
+	assert.Len(t, rules, 1)
+	sb, ok := rules[0](&combind.Combination{
+		Types:   map[string]*combind.SearchBox{"brand": {Key: "volvo", Type: "brand"}},
+		Matches: []combind.Key{{"brand": "volvo"}},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, "volvo", sb.Key)
+	assert.Equal(t, "brands", sb.Type)
+
+	_, ok = rules[0](&combind.Combination{Types: map[string]*combind.SearchBox{}})
+	assert.False(t, ok)
+}
+
+func TestRuleDefinitionsRulesDefaultTheOutputType(t *testing.T) {
+	ctx := context.Background()
+	defs, err := combind.ParseRuleDefinitions([]byte(`{"rules": [{"when": [{"type": "brand"}], "output": {"key": "{brand.key}"}}]}`))
+	assert.NoError(t, err)
+
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+	)
+	vc := combind.NewVirtualComponent("brands", nil, combind.WithContextCombiner(combind.JoinCombiner()),
+		combind.WithDependency(combind.NewRoot("brand", storage)),
+		combind.WithRule(defs.Rules("brands")...),
+	)
+
+	boxes, err := vc.Build(ctx, true)
+	assert.NoError(t, err)
+	if assert.Len(t, boxes, 1) {
+		assert.Equal(t, "volvo", boxes[0].Key)
+		assert.Equal(t, "brands", boxes[0].Type)
+	}
+}
+
+func TestParseRuleDefinitionsRejectsInvalidTemplates(t *testing.T) {
+	_, err := combind.ParseRuleDefinitions([]byte(`{"rules": [{"when": [{"type": "brand"}], "output": {"key": "{brand.name}"}}]}`))
+	assert.Error(t, err)
+
+	_, err = combind.ParseRuleDefinitions([]byte(`{"rules": [{"when": [{"type": "brand"}], "output": {"key": "{brand.key"}}]}`))
+	assert.Error(t, err)
+}
+
+func TestParseRuleDefinitionsRejectsUnknownFieldsAndMissingConditions(t *testing.T) {
+	_, err := combind.ParseRuleDefinitions([]byte(`
+rules:
+  - name: fixed
+    whne:
+      - type: brand
+        keys: [volvo]
+    output:
+      key: fixed
+`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "field whne not found")
+	}
+
+	_, err = combind.ParseRuleDefinitions([]byte(`{"rules": [{"name": "fixed", "output": {"key": "fixed"}}]}`))
+	assert.EqualError(t, err, "rule fixed: rule without conditions")
+}
@@ -0,0 +1,232 @@
+package combind
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// buildSession builds a component graph in topological order, every component
+// exactly once, running independent branches in parallel
+type buildSession struct {
+	concurrency int
+	nodes       map[string]*sessionNode
+	// emit receives the boxes of the top level components when streaming
+	emit   func(*SearchBox) error
+	emitMu sync.Mutex
+}
+
+type sessionNode struct {
+	component    Component
+	topLevel     bool
+	dependencies []string
+	dependents   []string
+	result       []*SearchBox
+}
+
+func newBuildSession(components []Component, concurrency int) (*buildSession, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	s := &buildSession{
+		concurrency: concurrency,
+		nodes:       map[string]*sessionNode{},
+	}
+
+	var add func(c Component)
+	add = func(c Component) {
+		if _, ok := s.nodes[c.Type()]; ok {
+			return
+		}
+		n := &sessionNode{
+			component: c,
+		}
+		s.nodes[c.Type()] = n
+
+		seen := map[string]bool{}
+		for _, child := range c.Children() {
+			if seen[child.Type()] {
+				continue
+			}
+			seen[child.Type()] = true
+			n.dependencies = append(n.dependencies, child.Type())
+			add(child)
+		}
+	}
+
+	for _, c := range components {
+		add(c)
+		s.nodes[c.Type()].topLevel = true
+	}
+
+	for _, typ := range s.types() {
+		for _, dep := range s.nodes[typ].dependencies {
+			s.nodes[dep].dependents = append(s.nodes[dep].dependents, typ)
+		}
+	}
+
+	if _, err := s.order(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *buildSession) types() []string {
+	types := []string{}
+	for typ := range s.nodes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// order returns the component types with every dependency before its dependents
+func (s *buildSession) order() ([]string, error) {
+	pending := map[string]int{}
+	ready := []string{}
+	for _, typ := range s.types() {
+		pending[typ] = len(s.nodes[typ].dependencies)
+		if pending[typ] == 0 {
+			ready = append(ready, typ)
+		}
+	}
+
+	order := []string{}
+	for len(ready) > 0 {
+		typ := ready[0]
+		ready = ready[1:]
+		order = append(order, typ)
+		for _, dependent := range s.nodes[typ].dependents {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(order) != len(s.nodes) {
+		cyclic := []string{}
+		for _, typ := range s.types() {
+			if pending[typ] > 0 {
+				cyclic = append(cyclic, typ)
+			}
+		}
+		return nil, fmt.Errorf("dependency cycle between %v", cyclic)
+	}
+
+	return order, nil
+}
+
+type sessionBuild struct {
+	typ string
+	err error
+}
+
+// stream runs the session sending the boxes of the top level components to
+// emit as soon as each of them is built, instead of keeping them as results.
+// Top level components no other component depends on are built with BuildEach
+// when they are a StreamingComponent. Emit is never called concurrently
+func (s *buildSession) stream(ctx context.Context, emit func(*SearchBox) error) error {
+	s.emit = emit
+	defer func() {
+		s.emit = nil
+	}()
+	return s.run(ctx)
+}
+
+// run builds every component once its dependencies are built. Dependencies are
+// then served from the fresh cached build of each component
+func (s *buildSession) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pending := map[string]int{}
+	ready := []string{}
+	for _, typ := range s.types() {
+		pending[typ] = len(s.nodes[typ].dependencies)
+		if pending[typ] == 0 {
+			ready = append(ready, typ)
+		}
+	}
+
+	finished := make(chan sessionBuild)
+	running := 0
+	var buildErr error
+
+	for {
+		for buildErr == nil && running < s.concurrency && len(ready) > 0 {
+			typ := ready[0]
+			ready = ready[1:]
+			running++
+
+			go func(typ string, n *sessionNode) {
+				start := time.Now()
+				log.Debugf("Running %s", typ)
+				err := s.build(ctx, n)
+				log.Debugf("%s took %d MS", typ, time.Since(start).Milliseconds())
+				finished <- sessionBuild{typ: typ, err: err}
+			}(typ, s.nodes[typ])
+		}
+
+		if running == 0 {
+			break
+		}
+
+		b := <-finished
+		running--
+		if b.err != nil {
+			if buildErr == nil {
+				buildErr = b.err
+				cancel()
+			}
+			continue
+		}
+
+		for _, dependent := range s.nodes[b.typ].dependents {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	return buildErr
+}
+
+// build builds a component of the session and sends its boxes to emit when streaming
+func (s *buildSession) build(ctx context.Context, n *sessionNode) error {
+	if s.emit == nil || !n.topLevel {
+		result, err := n.component.Build(ctx, true)
+		n.result = result
+		return err
+	}
+
+	if sc, ok := n.component.(StreamingComponent); ok && len(n.dependents) == 0 {
+		return sc.BuildEach(ctx, s.emitLocked)
+	}
+
+	result, err := n.component.Build(ctx, true)
+	if err != nil {
+		return err
+	}
+	return searchBoxSlice(result)(s.emitLocked)
+}
+
+func (s *buildSession) emitLocked(sb *SearchBox) error {
+	s.emitMu.Lock()
+	defer s.emitMu.Unlock()
+	return s.emit(sb)
+}
+
+func (s *buildSession) result(typ string) []*SearchBox {
+	if n, ok := s.nodes[typ]; ok {
+		return n.result
+	}
+	return nil
+}
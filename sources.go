@@ -0,0 +1,139 @@
+package combind
+
+import (
+	"sort"
+	"sync"
+)
+
+// WithIncremental records the dependency boxes every match is built from
+// starting with the first build, so that the first BuildIncremental already
+// recomputes only the changed combinations. Without it the sources are
+// recorded once the component is asked to build incrementally, and the first
+// BuildIncremental builds in full
+func WithIncremental() VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		vc.incremental = true
+	}
+}
+
+// sourceRecorder holds the dependency boxes the matches of a build came from,
+// for incremental builds to drop the matches built from changed boxes. The box
+// keys are interned per dependency type and every rule result is held as its
+// matches with the ids of its source boxes, without hashing the matches. A nil
+// recorder records nothing
+type sourceRecorder struct {
+	mu    sync.Mutex
+	types []string
+	ids   []map[string]int32
+	boxes map[string][]sourcedMatches
+}
+
+// sourcedMatches are the matches of a rule result and the ids of the boxes of
+// its combination per dependency type, -1 for a type without a box
+type sourcedMatches struct {
+	matches []Key
+	sources []int32
+}
+
+func newSourceRecorder(dependencies map[string]Component) *sourceRecorder {
+	r := &sourceRecorder{
+		boxes: map[string][]sourcedMatches{},
+	}
+	for typ := range dependencies {
+		r.types = append(r.types, typ)
+	}
+	sort.Strings(r.types)
+	for range r.types {
+		r.ids = append(r.ids, map[string]int32{})
+	}
+	return r
+}
+
+func (r *sourceRecorder) record(boxKey string, combination *Combination, matches []Key) {
+	if r == nil || len(matches) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sources := make([]int32, len(r.types))
+	for i, typ := range r.types {
+		sources[i] = -1
+		if sb, ok := combination.Types[typ]; ok {
+			id, ok := r.ids[i][sb.Key]
+			if !ok {
+				id = int32(len(r.ids[i]))
+				r.ids[i][sb.Key] = id
+			}
+			sources[i] = id
+		}
+	}
+	r.boxes[boxKey] = append(r.boxes[boxKey], sourcedMatches{matches: matches, sources: sources})
+}
+
+// dirtySources returns the ids of the dirty box keys per dependency type
+func (r *sourceRecorder) dirtySources(dirty map[string]map[string]bool) []map[int32]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]map[int32]bool, len(r.types))
+	for i, typ := range r.types {
+		ids[i] = map[int32]bool{}
+		for key := range dirty[typ] {
+			if id, ok := r.ids[i][key]; ok {
+				ids[i][id] = true
+			}
+		}
+	}
+	return ids
+}
+
+// keep drops the rule results of a box built from a dirty box and returns the
+// matches of the remaining ones
+func (r *sourceRecorder) keep(boxKey string, dirty []map[int32]bool) []Key {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := []sourcedMatches{}
+	matches := []Key{}
+	for _, sm := range r.boxes[boxKey] {
+		if !sm.builtFrom(dirty) {
+			kept = append(kept, sm)
+			matches = append(matches, sm.matches...)
+		}
+	}
+	if len(kept) == 0 {
+		delete(r.boxes, boxKey)
+		return nil
+	}
+	r.boxes[boxKey] = kept
+	return matches
+}
+
+// prune drops the rule results of boxes no longer built
+func (r *sourceRecorder) prune(boxes []*SearchBox) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	built := map[string][]sourcedMatches{}
+	for _, sb := range boxes {
+		if results, ok := r.boxes[sb.Key]; ok {
+			built[sb.Key] = results
+		}
+	}
+	r.boxes = built
+}
+
+func (sm sourcedMatches) builtFrom(dirty []map[int32]bool) bool {
+	for i, id := range sm.sources {
+		if id >= 0 && dirty[i][id] {
+			return true
+		}
+	}
+	return false
+}
@@ -9,8 +9,85 @@ type SearchFilter map[string]interface{}
 
 //SearchBoxStorage interface
 type SearchBoxStorage interface {
+	// Find returns the SearchBoxes of a type with all their Matches, sorted on key
 	Find(ctx context.Context, boxType string) ([]SearchBox, error)
 	Save(ctx context.Context, dn ...*SearchBox) error
+	Apply(ctx context.Context, diff BuildDiff) error
+}
+
+// StreamingSearchBoxStorage can read and write SearchBoxes one at a time.
+// Combind.Save and FindEach use it when the storage implements it, and fall
+// back to Save and Find otherwise
+type StreamingSearchBoxStorage interface {
+	SearchBoxStorage
+	// FindEach calls fn with every SearchBox of a type, sorted on key, without
+	// reading all of them into memory. It stops at the first error of fn
+	FindEach(ctx context.Context, boxType string, fn func(*SearchBox) error) error
+	// SaveEach saves the SearchBoxes sent by source like Save, writing them while
+	// source is still sending. Nothing is saved when source fails
+	SaveEach(ctx context.Context, source SearchBoxSource) error
+}
+
+// FindEach calls fn with every SearchBox of a type in the storage, streaming
+// them from a StreamingSearchBoxStorage and reading them with Find otherwise
+func FindEach(ctx context.Context, storage SearchBoxStorage, boxType string, fn func(*SearchBox) error) error {
+	if s, ok := storage.(StreamingSearchBoxStorage); ok {
+		return s.FindEach(ctx, boxType, fn)
+	}
+
+	boxes, err := storage.Find(ctx, boxType)
+	if err != nil {
+		return err
+	}
+	for i := range boxes {
+		if err := fn(&boxes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveEach saves the SearchBoxes sent by source, streaming them to a
+// StreamingSearchBoxStorage and collecting them for Save otherwise. Collected
+// boxes sent several times are saved as one box with all their matches
+func saveEach(ctx context.Context, storage SearchBoxStorage, source SearchBoxSource) error {
+	if s, ok := storage.(StreamingSearchBoxStorage); ok {
+		return s.SaveEach(ctx, source)
+	}
+
+	boxes := []*SearchBox{}
+	collected := map[string]*SearchBox{}
+	err := source(func(sb *SearchBox) error {
+		id := sb.Type + "_" + sb.Key
+		if c, ok := collected[id]; ok {
+			c.Matches = append(c.Matches, sb.Matches...)
+			return nil
+		}
+		sbCopy := *sb
+		sbCopy.Matches = append([]Key{}, sb.Matches...)
+		collected[id] = &sbCopy
+		boxes = append(boxes, &sbCopy)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return storage.Save(ctx, boxes...)
+}
+
+// SearchBoxSource sends SearchBoxes to emit, one at a time, and stops at the first error of emit
+type SearchBoxSource func(emit func(*SearchBox) error) error
+
+// searchBoxSlice is a SearchBoxSource sending the boxes of a slice
+func searchBoxSlice(boxes []*SearchBox) SearchBoxSource {
+	return func(emit func(*SearchBox) error) error {
+		for _, sb := range boxes {
+			if err := emit(sb); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 }
 
 //ComponentStorage interface
@@ -22,6 +99,16 @@ type ComponentStorage interface {
 	FilteredDelete(ctx context.Context, componentType string, searchFilter SearchFilter) (int, error)
 }
 
+// StreamingComponentStorage can read the components of a type one at a time.
+// Root components use it to stream their builds when the storage implements it
+type StreamingComponentStorage interface {
+	ComponentStorage
+	// SearchEach calls fn with every component of a type matching the filter,
+	// like Search, without reading all of them into memory. It stops at the
+	// first error of fn
+	SearchEach(ctx context.Context, componentType string, searchFilter SearchFilter, fn func(*BackendComponent) error) error
+}
+
 // BackendComponent ...
 type BackendComponent struct {
 	Code     string                 `json:"code"`
@@ -42,10 +129,15 @@ type Key = map[string]interface{}
 
 //SearchBox is the searchable model to be used
 type SearchBox struct {
-	Key       string                 `json:"key"`
-	Type      string                 `json:"type"`
-	Props     map[string]interface{} `json:"props"`
-	Match     Key                    `json:"match"`
-	HashMatch string                 `json:"hash_match"`
-	Matches   []Key                  `json:"-"`
+	Key         string                 `json:"key"`
+	Type        string                 `json:"type"`
+	Props       map[string]interface{} `json:"props"`
+	Match       Key                    `json:"match"`
+	HashMatch   string                 `json:"hash_match"`
+	HashVersion HashAlgorithm          `json:"hash_version,omitempty"`
+	Matches     []Key                  `json:"-"`
+	// Provenance of the Matches keyed on their Hash, see WithProvenanceInDocuments
+	Provenance map[string][]Provenance `json:"-"`
+	// MatchProvenance is the provenance of Match in a stored document
+	MatchProvenance []Provenance `json:"provenance,omitempty"`
 }
@@ -0,0 +1,108 @@
+package combind
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidationProblem is a single problem found in a component graph
+type ValidationProblem struct {
+	Path    []string
+	Message string
+}
+
+func (p ValidationProblem) String() string {
+	return fmt.Sprintf("%s: %s", strings.Join(p.Path, " > "), p.Message)
+}
+
+// ValidationError lists every problem found when validating a component graph
+type ValidationError struct {
+	Problems []ValidationProblem
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		problems = append(problems, p.String())
+	}
+	return fmt.Sprintf("invalid component graph: %s", strings.Join(problems, "; "))
+}
+
+// Validate checks a component graph for cycles, duplicate types, virtual
+// components without dependencies and rules referencing missing dependency
+// types. It returns a *ValidationError listing every problem, or nil
+func Validate(components ...Component) error {
+	v := &validator{
+		types: map[string]Component{},
+		done:  map[Component]bool{},
+	}
+
+	for _, c := range components {
+		v.visit(c, []string{})
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+type validator struct {
+	types    map[string]Component
+	done     map[Component]bool
+	stack    []Component
+	problems []ValidationProblem
+}
+
+func (v *validator) report(path []string, format string, args ...interface{}) {
+	v.problems = append(v.problems, ValidationProblem{
+		Path:    append([]string{}, path...),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) visit(c Component, parent []string) {
+	path := append(append([]string{}, parent...), c.Type())
+
+	for _, s := range v.stack {
+		if s == c {
+			v.report(path, "dependency cycle on type %s", c.Type())
+			return
+		}
+	}
+
+	if existing, ok := v.types[c.Type()]; ok && existing != c {
+		v.report(path, "duplicate component type %s", c.Type())
+	}
+	v.types[c.Type()] = c
+
+	if v.done[c] {
+		return
+	}
+
+	if vc, ok := c.(*VirtualComponent); ok {
+		if len(vc.dependencies) == 0 {
+			v.report(path, "virtual component has no dependencies")
+		}
+		for _, d := range vc.duplicates {
+			v.report(append(path, d.Type()), "duplicate dependency type %s", d.Type())
+		}
+		for _, typ := range vc.ruleTypes {
+			if _, ok := vc.dependencies[typ]; !ok {
+				v.report(path, "rules reference missing dependency type %s", typ)
+			}
+		}
+	}
+
+	v.stack = append(v.stack, c)
+	children := c.Children()
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Type() < children[j].Type()
+	})
+	for _, child := range children {
+		v.visit(child, path)
+	}
+	v.stack = v.stack[:len(v.stack)-1]
+	v.done[c] = true
+}
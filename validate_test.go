@@ -0,0 +1,43 @@
+package combind_test
+
+import (
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAcceptsValidGraph(t *testing.T) {
+	storage := combind.NewMemoryComponentStorage()
+	brand := combind.NewRoot("brand", storage)
+	model := combind.NewRoot("model", storage)
+	vc := combind.NewVirtualComponent("brand-model", nil,
+		combind.WithDependency(brand, model),
+		combind.WithRuleTypes("brand", "model"),
+	)
+
+	assert.NoError(t, combind.Validate(vc, brand))
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	storage := combind.NewMemoryComponentStorage()
+	a := combind.NewVirtualComponent("a", nil)
+	b := combind.NewVirtualComponent("b", nil, combind.WithDependency(a), combind.WithRuleTypes("c"))
+	combind.WithDependency(b)(a)
+	empty := combind.NewVirtualComponent("empty", nil)
+
+	_, err := combind.NewWithConfiguration(
+		combind.NewMemorySearchBoxStorage(),
+		[]combind.Component{a, empty, combind.NewRoot("empty", storage)},
+		combind.WithValidation(),
+	)
+
+	verr, ok := err.(*combind.ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, []combind.ValidationProblem{
+		{Path: []string{"a", "b"}, Message: "rules reference missing dependency type c"},
+		{Path: []string{"a", "b", "a"}, Message: "dependency cycle on type a"},
+		{Path: []string{"empty"}, Message: "virtual component has no dependencies"},
+		{Path: []string{"empty"}, Message: "duplicate component type empty"},
+	}, verr.Problems)
+}
@@ -2,8 +2,12 @@ package combind
 
 import (
 	"context"
+	"fmt"
 	"math"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/reveald/reveald"
 	log "github.com/sirupsen/logrus"
@@ -11,15 +15,24 @@ import (
 
 type VirtualComponent struct {
 	typ           string
-	combiner      Combiner
+	combiner      ContextCombiner
 	dependencies  map[string]Component
-	rules         []Rule
+	rules         []namedRule
 	noMappingRule Rule
 	result        []*SearchBox
 	maxNrMatches  int
 	props         map[string]interface{}
 	queryBuilder  QueryBuilder
 	handler       Handler
+	ruleTypes     []string
+	duplicates    []Component
+	workers       int
+	provenance    *provenanceRecorder
+	incremental   bool
+	sources       *sourceRecorder
+	policy        ConflictPolicy
+	owners        map[string]*boxOwner
+	conflicts     []RuleConflict
 }
 
 type Combination struct {
@@ -31,8 +44,23 @@ type Combination struct {
 
 type Rule func(combination *Combination) (*SearchBox, bool)
 
+type namedRule struct {
+	name     string
+	rule     Rule
+	index    int
+	priority int
+}
+
+// Combiner produces the combinations of the built dependencies. It is not told
+// when a build is cancelled, the combinations it still sends are drained for
+// 10 seconds, see ContextCombiner
 type Combiner func(dependency map[string][]*SearchBox) chan *Combination
 
+// ContextCombiner produces the combinations of the built dependencies. It must
+// stop sending and close the channel when ctx is cancelled, a combiner still
+// sending 10 seconds after that is left blocked
+type ContextCombiner func(ctx context.Context, dependency map[string][]*SearchBox) chan *Combination
+
 type VirtualComponentConfiguration func(*VirtualComponent)
 
 type VirtualComponentProperties interface{}
@@ -40,14 +68,60 @@ type VirtualComponentProperties interface{}
 func WithDependency(comp ...Component) VirtualComponentConfiguration {
 	return func(vc *VirtualComponent) {
 		for _, c := range comp {
+			if existing, ok := vc.dependencies[c.Type()]; ok && existing != c {
+				vc.duplicates = append(vc.duplicates, existing)
+			}
 			vc.dependencies[c.Type()] = c
 		}
 	}
 }
 
+// WithContextCombiner combines the dependencies with a ContextCombiner instead
+// of the Combiner of NewVirtualComponent, which can be nil, e.g
+//
+//	NewVirtualComponent("cars", nil, WithContextCombiner(JoinCombiner()))
+func WithContextCombiner(combiner ContextCombiner) VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		vc.combiner = combiner
+	}
+}
+
+// WithRule adds rules identified as rule-<index>, in registration order
 func WithRule(rule ...Rule) VirtualComponentConfiguration {
 	return func(vc *VirtualComponent) {
-		vc.rules = append(vc.rules, rule...)
+		for _, r := range rule {
+			vc.rules = append(vc.rules, namedRule{
+				name:  fmt.Sprintf("rule-%d", len(vc.rules)),
+				rule:  r,
+				index: len(vc.rules),
+			})
+		}
+	}
+}
+
+// WithNamedRule adds a rule with an identifier, used in provenance records
+func WithNamedRule(name string, rule Rule) VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		vc.rules = append(vc.rules, namedRule{
+			name:  name,
+			rule:  rule,
+			index: len(vc.rules),
+		})
+	}
+}
+
+// WithRuleTypes declares the dependency types the rules of the component read,
+// so that Validate can report rules referencing missing dependencies
+func WithRuleTypes(types ...string) VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		vc.ruleTypes = append(vc.ruleTypes, types...)
+	}
+}
+
+// WithWorkers sets the number of workers applying the rules to combinations
+func WithWorkers(workers int) VirtualComponentConfiguration {
+	return func(vc *VirtualComponent) {
+		vc.workers = workers
 	}
 }
 
@@ -80,7 +154,7 @@ func WithHandler(handler Handler) VirtualComponentConfiguration {
 func (vc *VirtualComponent) defaultNoMappingRule(combination *Combination) (*SearchBox, bool) {
 
 	return &SearchBox{
-		Key:     "not-mapped",
+		Key:     NotMappedKey,
 		Type:    vc.typ,
 		Props:   map[string]interface{}{},
 		Matches: combination.Matches,
@@ -90,10 +164,10 @@ func (vc *VirtualComponent) defaultNoMappingRule(combination *Combination) (*Sea
 func NewVirtualComponent(typ string, combiner Combiner, cfg ...VirtualComponentConfiguration) *VirtualComponent {
 	vc := &VirtualComponent{
 		typ:          typ,
-		combiner:     combiner,
-		rules:        []Rule{},
+		rules:        []namedRule{},
 		dependencies: map[string]Component{},
 		maxNrMatches: math.MaxInt32,
+		workers:      50,
 		props:        map[string]interface{}{},
 		queryBuilder: func(builder *reveald.QueryBuilder) {
 
@@ -104,6 +178,11 @@ func NewVirtualComponent(typ string, combiner Combiner, cfg ...VirtualComponentC
 	}
 
 	vc.noMappingRule = vc.defaultNoMappingRule
+	if combiner != nil {
+		vc.combiner = func(ctx context.Context, dependency map[string][]*SearchBox) chan *Combination {
+			return combiner(dependency)
+		}
+	}
 
 	for _, c := range cfg {
 		c(vc)
@@ -132,6 +211,173 @@ func (vc *VirtualComponent) Build(ctx context.Context, rebuild bool) ([]*SearchB
 		return vc.result, nil
 	}
 
+	ctx, done := observe(ctx, vc.typ)
+	result, err := vc.build(ctx)
+	done(len(result), err)
+	return result, err
+}
+
+// BuildEach sends the boxes of a full build to fn, sorted on key. The
+// combinations are evaluated once, the matches of every rule result are
+// spooled to a temporary file as the rules fire and every box is sent with its
+// matches read back once its Props are resolved. Only the boxes without their
+// matches, the position of every rule result in the spool and a hash per
+// mapped match are held. Components WithProvenance record every match and are
+// built in full before the boxes are sent
+func (vc *VirtualComponent) BuildEach(ctx context.Context, fn func(*SearchBox) error) error {
+	ctx, done := observe(ctx, vc.typ)
+	vc.result = nil
+	if vc.provenance != nil {
+		result, err := vc.build(ctx)
+		vc.result = nil
+		if err == nil {
+			err = searchBoxSlice(result)(fn)
+		}
+		done(len(result), err)
+		return err
+	}
+
+	boxes, err := vc.stream(ctx, fn)
+	done(boxes, err)
+	return err
+}
+
+// stream sends the boxes of a full build with the matches spooled while
+// combining and returns the number of boxes
+func (vc *VirtualComponent) stream(ctx context.Context, fn func(*SearchBox) error) (int, error) {
+	builtDependencies, err := vc.dependencyBuilds(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	spool, err := newMatchSpool()
+	if err != nil {
+		return 0, err
+	}
+	defer spool.close()
+
+	// place the boxes without their matches and spool the matches of every rule result
+	resultMutex := sync.Mutex{}
+	boxes := map[string]*SearchBox{}
+	spooled := map[string][]spooledMatches{}
+	mapped := map[[16]byte]bool{}
+	// the not mapped boxes first built by the no mapping rule, with every match
+	// of that result, and the results of the no mapping rule to filter on mapped
+	unmappedBoxes := map[string]*SearchBox{}
+	unmappedWhole := map[string]spooledMatches{}
+	unmapped := map[string][]spooledMatches{}
+	counter := int64(0)
+	unmatched := 0
+	ruleCounts := map[string]int64{}
+	vc.owners = map[string]*boxOwner{}
+	vc.conflicts = []RuleConflict{}
+	err = vc.combine(ctx, builtDependencies, func(combination *Combination, matched []ruleResult) error {
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+
+		counter++
+		if len(matched) == 0 {
+			unmatched++
+			result, ok := vc.unmappedResult(combination)
+			if !ok {
+				return nil
+			}
+			sm, err := spool.write(result.Matches)
+			if err != nil {
+				return err
+			}
+			if _, ok := unmappedBoxes[result.Key]; !ok {
+				box := *result
+				box.Matches = nil
+				unmappedBoxes[result.Key] = &box
+				unmappedWhole[result.Key] = sm
+			}
+			unmapped[result.Key] = append(unmapped[result.Key], sm)
+			return nil
+		}
+		for _, m := range matched {
+			sm, err := spool.write(m.result.Matches)
+			if err != nil {
+				return err
+			}
+			for _, k := range m.result.Matches {
+				mapped[matchID(k)] = true
+			}
+			box := *m.result
+			box.Matches = nil
+			vc.place(boxes, m.rule, &box)
+			spooled[box.Key] = append(spooled[box.Key], sm)
+			ruleCounts[m.rule.name]++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := vc.conflictError(); err != nil {
+		return 0, err
+	}
+	if err := spool.flush(); err != nil {
+		return 0, err
+	}
+
+	vc.report(ctx, counter, ruleCounts, unmatched)
+
+	keys := []string{}
+	for key := range boxes {
+		keys = append(keys, key)
+	}
+	for key := range unmappedBoxes {
+		if _, ok := boxes[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		box, ok := boxes[key]
+		matches, err := spool.read(spooled[key]...)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			// like a full build, the box takes every match of the first no mapping result
+			box = unmappedBoxes[key]
+			if matches, err = spool.read(unmappedWhole[key]); err != nil {
+				return 0, err
+			}
+		}
+		candidates, err := spool.read(unmapped[key]...)
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range candidates {
+			if !mapped[matchID(m)] {
+				matches = append(matches, m)
+			}
+		}
+
+		sb := *box
+		sb.Matches = DedupKeys(matches)
+		if err := fn(&sb); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+func (vc *VirtualComponent) build(ctx context.Context) ([]*SearchBox, error) {
+	builtDependencies, err := vc.dependencyBuilds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return vc.buildFrom(ctx, builtDependencies)
+}
+
+// dependencyBuilds returns the builds of the dependencies, keyed on type
+func (vc *VirtualComponent) dependencyBuilds(ctx context.Context) (map[string][]*SearchBox, error) {
 	builtDependencies := map[string][]*SearchBox{}
 	for typ, dependency := range vc.dependencies {
 		dependencyBuild, err := dependency.Build(ctx, false)
@@ -140,57 +386,321 @@ func (vc *VirtualComponent) Build(ctx context.Context, rebuild bool) ([]*SearchB
 		}
 		builtDependencies[typ] = dependencyBuild
 	}
+	return builtDependencies, nil
+}
 
+// buildFrom evaluates every combination of the built dependencies, recording
+// the sources of the matches when the component builds incrementally
+func (vc *VirtualComponent) buildFrom(ctx context.Context, builtDependencies map[string][]*SearchBox) ([]*SearchBox, error) {
 	results := map[string]*SearchBox{}
-	resultMutex := sync.RWMutex{}
+	mappedKeys := map[string]bool{}
+	vc.provenance.reset()
+	vc.sources = nil
+	if vc.incremental {
+		vc.sources = newSourceRecorder(vc.dependencies)
+	}
+	vc.owners = map[string]*boxOwner{}
+	vc.conflicts = []RuleConflict{}
+	if err := vc.evaluate(ctx, builtDependencies, results, mappedKeys); err != nil {
+		return nil, err
+	}
+	if err := vc.conflictError(); err != nil {
+		return nil, err
+	}
+
+	vc.result = vc.collect(results)
+
+	return vc.result, nil
+}
+
+// BuildIncremental recomputes only the combinations built from dependency
+// boxes changed by the changed root codes and merges them into the previous
+// result. The first call, without the sources of a previous build recorded, see
+// WithIncremental, builds in full from the dependencies refreshed for the
+// changes and records them for the following ones
+func (vc *VirtualComponent) BuildIncremental(ctx context.Context, changes Changes) ([]*SearchBox, error) {
+
+	if vc.result != nil && !changes.affects(vc) {
+		return vc.result, nil
+	}
+
+	vc.incremental = true
+	ctx, done := observe(ctx, vc.typ)
+	builtDependencies, dirty, err := vc.buildDependencies(ctx, changes)
+	var result []*SearchBox
+	if err == nil {
+		result, err = vc.refresh(ctx, builtDependencies, dirty)
+	}
+	done(len(result), err)
+	return result, err
+}
+
+// refreshChanged is BuildIncremental for dependencies already refreshed, given
+// the keys of their changed boxes per type, nil when unknown, see Combind.Update
+func (vc *VirtualComponent) refreshChanged(ctx context.Context, changed map[string]map[string]bool) ([]*SearchBox, error) {
+	vc.incremental = true
+	ctx, done := observe(ctx, vc.typ)
+	builtDependencies, err := vc.dependencyBuilds(ctx)
+	var result []*SearchBox
+	if err == nil {
+		dirty := map[string]map[string]bool{}
+		for typ := range vc.dependencies {
+			if keys, ok := changed[typ]; ok {
+				dirty[typ] = keys
+			}
+		}
+		result, err = vc.refresh(ctx, builtDependencies, dirty)
+	}
+	done(len(result), err)
+	return result, err
+}
+
+// refresh merges the combinations of the dirty dependency boxes into the
+// previous result, or builds in full when the sources of the previous result
+// or the changed boxes of a dependency are unknown
+func (vc *VirtualComponent) refresh(ctx context.Context, builtDependencies map[string][]*SearchBox, dirty map[string]map[string]bool) ([]*SearchBox, error) {
+	if vc.result == nil || vc.sources == nil {
+		return vc.buildFrom(ctx, builtDependencies)
+	}
+	for _, keys := range dirty {
+		if keys == nil {
+			return vc.buildFrom(ctx, builtDependencies)
+		}
+	}
+	return vc.buildIncremental(ctx, builtDependencies, dirty)
+}
+
+func (vc *VirtualComponent) buildIncremental(ctx context.Context, builtDependencies map[string][]*SearchBox, dirty map[string]map[string]bool) ([]*SearchBox, error) {
 
+	vc.conflicts = []RuleConflict{}
+
+	// keep every match still built from a combination without dirty boxes
+	vc.owners = map[string]*boxOwner{}
+	results := map[string]*SearchBox{}
 	mappedKeys := map[string]bool{}
+	dirtySources := vc.sources.dirtySources(dirty)
+	for _, sb := range vc.result {
+		kept := vc.sources.keep(sb.Key, dirtySources)
+		if len(kept) == 0 {
+			continue
+		}
+		for _, m := range kept {
+			mappedKeys[Hash(m)] = true
+		}
+		sbCopy := *sb
+		sbCopy.Matches = kept
+		results[sb.Key] = &sbCopy
+
+		vc.owners[sb.Key] = &boxOwner{kept: true}
+	}
+
+	// rerun the combinations where at least one dependency is restricted to its dirty boxes
+	for _, typ := range sortedDirtyTypes(dirty) {
+		restricted := map[string][]*SearchBox{}
+		for t, boxes := range builtDependencies {
+			restricted[t] = boxes
+		}
+		restricted[typ] = dirtySearchBoxes(builtDependencies[typ], dirty[typ])
+		if len(restricted[typ]) == 0 {
+			continue
+		}
+		if err := vc.evaluate(ctx, restricted, results, mappedKeys); err != nil {
+			return nil, err
+		}
+	}
+	if err := vc.conflictError(); err != nil {
+		return nil, err
+	}
+
+	vc.result = vc.collect(results)
+
+	return vc.result, nil
+}
+
+// buildDependencies builds the dependencies, refreshing the ones affected by
+// the changes, and returns the keys of their created, updated and deleted
+// boxes per dependency type, nil when the previous build of a dependency is
+// unknown
+func (vc *VirtualComponent) buildDependencies(ctx context.Context, changes Changes) (map[string][]*SearchBox, map[string]map[string]bool, error) {
+	builtDependencies := map[string][]*SearchBox{}
+	dirty := map[string]map[string]bool{}
+	for typ, dependency := range vc.dependencies {
+		inc, ok := dependency.(IncrementalComponent)
+		if !ok || !changes.affects(dependency) {
+			dependencyBuild, err := dependency.Build(ctx, false)
+			if err != nil {
+				return nil, nil, err
+			}
+			builtDependencies[typ] = dependencyBuild
+			continue
+		}
+
+		previous, known, err := previousBuild(ctx, dependency)
+		if err != nil {
+			return nil, nil, err
+		}
+		dependencyBuild, err := inc.BuildIncremental(ctx, changes)
+		if err != nil {
+			return nil, nil, err
+		}
+		builtDependencies[typ] = dependencyBuild
+		dirty[typ] = changedBoxKeys(dependency, changes, previous, known, dependencyBuild)
+	}
+	return builtDependencies, dirty, nil
+}
+
+// previousBuild returns the build of a dependency before it is refreshed for
+// changes, reporting false when it is unknown, as for a virtual component that
+// streamed its boxes
+func previousBuild(ctx context.Context, dependency Component) ([]*SearchBox, bool, error) {
+	switch c := dependency.(type) {
+	case *RootComponent:
+		return nil, true, nil
+	case *VirtualComponent:
+		if c.result == nil {
+			return nil, false, nil
+		}
+	}
+	previous, err := dependency.Build(ctx, false)
+	return previous, err == nil, err
+}
+
+// changedBoxKeys returns the keys of the boxes of a dependency created,
+// updated or deleted when refreshing it for the changes, nil when unknown
+func changedBoxKeys(dependency Component, changes Changes, previous []*SearchBox, known bool, built []*SearchBox) map[string]bool {
+	if !known {
+		return nil
+	}
+	keys := map[string]bool{}
+	if _, ok := dependency.(*RootComponent); ok {
+		// the boxes of a root are keyed on the codes
+		for _, code := range changes[dependency.Type()] {
+			keys[code] = true
+		}
+		return keys
+	}
+	diff := diffSearchBoxes(previous, built)
+	for _, boxes := range [][]*SearchBox{diff.Created, diff.Updated, diff.Deleted} {
+		for _, sb := range boxes {
+			keys[sb.Key] = true
+		}
+	}
+	return keys
+}
+
+func sortedDirtyTypes(dirty map[string]map[string]bool) []string {
+	types := []string{}
+	for typ := range dirty {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// dirtySearchBoxes returns the boxes with a dirty key
+func dirtySearchBoxes(boxes []*SearchBox, dirty map[string]bool) []*SearchBox {
+	result := []*SearchBox{}
+	for _, sb := range boxes {
+		if dirty[sb.Key] {
+			result = append(result, sb)
+		}
+	}
+	return result
+}
+
+// evaluate runs the combiner over the dependencies and adds the rule results to results
+func (vc *VirtualComponent) evaluate(ctx context.Context, builtDependencies map[string][]*SearchBox, results map[string]*SearchBox, mappedKeys map[string]bool) error {
+	resultMutex := sync.Mutex{}
 	unmatchedCombinations := []*Combination{}
-	unmatchedLock := sync.RWMutex{}
-	counter := 0
+	counter := int64(0)
+	ruleCounts := map[string]int64{}
 
-	worker := func(combinations <-chan *Combination) {
-		for combination := range combinations {
-			counter++
-			if counter%10 == 0 {
-				log.Debugf("Processed %d items", counter)
-			}
-			nrMatches := 0
-			for _, rule := range vc.rules {
-				result, didMatch := rule(combination)
-				if !didMatch {
-					continue
-				}
+	err := vc.combine(ctx, builtDependencies, func(combination *Combination, matched []ruleResult) error {
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
 
-				result.Props = Merge(vc.props, result.Props)
+		counter++
+		if len(matched) == 0 {
+			unmatchedCombinations = append(unmatchedCombinations, combination)
+			return nil
+		}
+		for _, m := range matched {
+			result := m.result
+			vc.place(results, m.rule, result)
+			results[result.Key].Matches = append(results[result.Key].Matches, result.Matches...)
 
-				nrMatches = nrMatches + 1
-				resultMutex.Lock()
-				if _, ok := results[result.Key]; !ok {
-					results[result.Key] = result
-				}
-				results[result.Key].Matches = append(results[result.Key].Matches, result.Matches...)
+			for _, k := range result.Matches {
+				mappedKeys[Hash(k)] = true
+			}
+			vc.provenance.record(result.Key, m.rule.name, combination, result.Matches)
+			vc.sources.record(result.Key, combination, result.Matches)
+			ruleCounts[m.rule.name]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-				for _, k := range results[result.Key].Matches {
-					mappedKeys[Hash(k)] = true
-				}
-				resultMutex.Unlock()
+	vc.report(ctx, counter, ruleCounts, len(unmatchedCombinations))
 
-				if nrMatches >= vc.maxNrMatches {
-					break
+	for _, uc := range unmatchedCombinations {
+		if key, unmapped, ok := vc.placeUnmapped(results, uc, mappedKeys); ok {
+			vc.provenance.record(key, NoMappingRuleName, uc, unmapped)
+			vc.sources.record(key, uc, unmapped)
+		}
+	}
+
+	return nil
+}
+
+// combine runs the combiner over the dependencies and calls fn from the
+// workers with every combination and the rules matching it, with the Props of
+// the component merged into their results. It stops at the first error of fn
+func (vc *VirtualComponent) combine(ctx context.Context, builtDependencies map[string][]*SearchBox, fn func(*Combination, []ruleResult) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	counter := int64(0)
+	var fnErr error
+	fnOnce := sync.Once{}
+
+	worker := func(combinations <-chan *Combination) {
+		for {
+			var combination *Combination
+			select {
+			case <-ctx.Done():
+				return
+			case c, ok := <-combinations:
+				if !ok {
+					return
 				}
+				combination = c
 			}
 
-			if nrMatches == 0 {
-				unmatchedLock.Lock()
-				unmatchedCombinations = append(unmatchedCombinations, combination)
-				unmatchedLock.Unlock()
+			if processed := atomic.AddInt64(&counter, 1); processed%10 == 0 {
+				log.Debugf("Processed %d items", processed)
+			}
+			matched := vc.applicableRules(combination)
+			for _, m := range matched {
+				m.result.Props = Merge(vc.props, m.result.Props)
+			}
+			if err := fn(combination, matched); err != nil {
+				fnOnce.Do(func() {
+					fnErr = err
+					cancel()
+				})
+				return
 			}
 		}
 	}
 	whg := sync.WaitGroup{}
-	ch := vc.combiner(builtDependencies)
-	for i := 0; i < 50; i++ {
+	ch := vc.combiner(ctx, builtDependencies)
+	workers := vc.workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
 		whg.Add(1)
 		go func() {
 			defer whg.Done()
@@ -200,38 +710,97 @@ func (vc *VirtualComponent) Build(ctx context.Context, rebuild bool) ([]*SearchB
 
 	whg.Wait()
 
-	for _, uc := range unmatchedCombinations {
-		result, ok := vc.noMappingRule(uc)
-		if !ok {
-			log.Warnf("Default rule not matched, this must be an error. Check the default handler for type %s...", vc.typ)
-			continue
+	if fnErr != nil {
+		go vc.drain(ch)
+		return fnErr
+	}
+	if err := ctx.Err(); err != nil {
+		go vc.drain(ch)
+		return err
+	}
+	return nil
+}
+
+// report notifies the observer of the combinations of a build
+func (vc *VirtualComponent) report(ctx context.Context, combinations int64, ruleCounts map[string]int64, unmatched int) {
+	observer := ObserverFromContext(ctx)
+	observer.CombinationsProduced(ctx, vc.typ, combinations)
+	for _, rule := range vc.rules {
+		if count, ok := ruleCounts[rule.name]; ok {
+			observer.RuleMatched(ctx, vc.typ, rule.name, count)
 		}
-		result.Props = Merge(vc.props, result.Props)
+	}
+	observer.Unmatched(ctx, vc.typ, int64(unmatched))
+}
 
-		if _, ok := results[result.Key]; !ok {
-			results[result.Key] = result
+// unmappedResult runs the no mapping rule on a combination no rule matched,
+// with the Props of the component merged into its result
+func (vc *VirtualComponent) unmappedResult(uc *Combination) (*SearchBox, bool) {
+	result, ok := vc.noMappingRule(uc)
+	if !ok {
+		log.Warnf("Default rule not matched, this must be an error. Check the default handler for type %s...", vc.typ)
+		return nil, false
+	}
+	result.Props = Merge(vc.props, result.Props)
+	return result, true
+}
+
+// placeUnmapped applies the no mapping rule to a combination no rule matched
+// and adds the matches no rule mapped to its box in results. It returns the
+// key of the box and the added matches
+func (vc *VirtualComponent) placeUnmapped(results map[string]*SearchBox, uc *Combination, mappedKeys map[string]bool) (string, []Key, bool) {
+	result, ok := vc.unmappedResult(uc)
+	if !ok {
+		return "", nil, false
+	}
+
+	if _, ok := results[result.Key]; !ok {
+		results[result.Key] = result
+	}
+
+	ummappedKeys := []Key{}
+	for _, m := range result.Matches {
+		if _, ok := mappedKeys[Hash(m)]; !ok {
+			ummappedKeys = append(ummappedKeys, m)
 		}
+	}
 
-		ummappedKeys := []Key{}
-		for _, m := range result.Matches {
-			if _, ok := mappedKeys[Hash(m)]; !ok {
-				ummappedKeys = append(ummappedKeys, m)
+	results[result.Key].Matches = append(results[result.Key].Matches, ummappedKeys...)
+	return result.Key, ummappedKeys, true
+}
+
+// combinerCloseTimeout is how long a cancelled combiner may keep its channel open
+const combinerCloseTimeout = 10 * time.Second
+
+// drain unblocks a cancelled combiner still sending, until it closes its channel
+// or combinerCloseTimeout passed
+func (vc *VirtualComponent) drain(ch <-chan *Combination) {
+	timeout := time.NewTimer(combinerCloseTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
 			}
+		case <-timeout.C:
+			log.Errorf("The combiner of %s did not close its channel after being cancelled", vc.typ)
+			return
 		}
-
-		results[result.Key].Matches = append(results[result.Key].Matches, ummappedKeys...)
 	}
+}
 
+func (vc *VirtualComponent) collect(results map[string]*SearchBox) []*SearchBox {
 	buildResults := []*SearchBox{}
 
 	for _, c := range results {
 		c.Matches = DedupKeys(c.Matches)
 		buildResults = append(buildResults, c)
 	}
+	vc.provenance.prune(buildResults)
+	vc.sources.prune(buildResults)
 
-	vc.result = buildResults
-
-	return buildResults, nil
+	return buildResults
 }
 
 func (vc *VirtualComponent) BuildQuery(builder *reveald.QueryBuilder) {
@@ -0,0 +1,261 @@
+package combind_test
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ourstudio-se/combind/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// brandModelComponent maps every model to a box, with the brand and model
+// matches or, when projected, only the brand matches
+func brandModelComponent(storage combind.ComponentStorage, projected ...bool) *combind.VirtualComponent {
+	brand := combind.NewRoot("brand", storage)
+	model := combind.NewRoot("model", storage)
+
+	return combind.NewVirtualComponent("brand-model", nil,
+		combind.WithContextCombiner(func(ctx context.Context, deps map[string][]*combind.SearchBox) chan *combind.Combination {
+			return combind.DependencyMergeContext(ctx, nil, deps["brand"], deps["model"])
+		}),
+		combind.WithDependency(brand, model),
+		combind.WithRule(brandModelRule(len(projected) > 0 && projected[0])),
+	)
+}
+
+func brandModelRule(projected bool) combind.Rule {
+	return func(c *combind.Combination) (*combind.SearchBox, bool) {
+		b, m := c.Types["brand"], c.Types["model"]
+		if m.Props["brand"] != b.Key {
+			return nil, false
+		}
+		matches := c.Matches
+		if projected {
+			matches = b.Matches
+		}
+		return &combind.SearchBox{
+			Key:     m.Key,
+			Type:    "brand-model",
+			Props:   map[string]interface{}{"brand": b.Props["name"]},
+			Matches: matches,
+		}, true
+	}
+}
+
+func boxKeys(boxes []*combind.SearchBox) []string {
+	keys := []string{}
+	for _, sb := range boxes {
+		keys = append(keys, sb.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func assertSameBuild(t *testing.T, full []*combind.SearchBox, incremental []*combind.SearchBox) {
+	assert.Equal(t, boxKeys(full), boxKeys(incremental))
+	for _, sb := range incremental {
+		for _, fsb := range full {
+			if fsb.Key == sb.Key {
+				assert.ElementsMatch(t, fsb.Matches, sb.Matches, sb.Key)
+			}
+		}
+	}
+}
+
+func TestBuildIncrementalMatchesFullBuild(t *testing.T) {
+	for _, projected := range []bool{false, true} {
+		ctx := context.Background()
+		storage := combind.NewMemoryComponentStorage(
+			&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+			&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+			&combind.BackendComponent{Code: "v70", Type: "model", Props: map[string]interface{}{"brand": "volvo"}},
+			&combind.BackendComponent{Code: "9-5", Type: "model", Props: map[string]interface{}{"brand": "saab"}},
+		)
+
+		vc := brandModelComponent(storage, projected)
+		_, err := vc.Build(ctx, true)
+		assert.NoError(t, err)
+
+		xc90 := &combind.BackendComponent{Code: "xc90", Type: "model", Props: map[string]interface{}{"brand": "volvo"}}
+		saab95 := &combind.BackendComponent{Code: "9-5", Type: "model"}
+		assert.NoError(t, storage.Save(ctx, xc90))
+		assert.NoError(t, storage.Delete(ctx, saab95))
+
+		incremental, err := vc.BuildIncremental(ctx, combind.ChangesOf(xc90, saab95))
+		assert.NoError(t, err)
+
+		full, err := brandModelComponent(storage, projected).Build(ctx, true)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []string{"not-mapped", "v70", "xc90"}, boxKeys(incremental))
+		assertSameBuild(t, full, incremental)
+
+		// matches projected on the brand don't carry the deleted model
+		v70 := &combind.BackendComponent{Code: "v70", Type: "model"}
+		assert.NoError(t, storage.Delete(ctx, v70))
+
+		incremental, err = vc.BuildIncremental(ctx, combind.ChangesOf(v70))
+		assert.NoError(t, err)
+
+		full, err = brandModelComponent(storage, projected).Build(ctx, true)
+		assert.NoError(t, err)
+
+		assert.NotContains(t, boxKeys(incremental), "v70")
+		assertSameBuild(t, full, incremental)
+	}
+}
+
+func TestBuildIncrementalReevaluatesOnlyTheChangedCombinations(t *testing.T) {
+	ctx := context.Background()
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+		&combind.BackendComponent{Code: "v70", Type: "model", Props: map[string]interface{}{"brand": "volvo"}},
+		&combind.BackendComponent{Code: "9-5", Type: "model", Props: map[string]interface{}{"brand": "saab"}},
+	)
+	component := func(evaluations *int64, cfg ...combind.VirtualComponentConfiguration) *combind.VirtualComponent {
+		rule := brandModelRule(false)
+		return combind.NewVirtualComponent("brand-model", nil, append([]combind.VirtualComponentConfiguration{
+			combind.WithContextCombiner(func(ctx context.Context, deps map[string][]*combind.SearchBox) chan *combind.Combination {
+				return combind.DependencyMergeContext(ctx, nil, deps["brand"], deps["model"])
+			}),
+			combind.WithDependency(combind.NewRoot("brand", storage), combind.NewRoot("model", storage)),
+			combind.WithRule(func(c *combind.Combination) (*combind.SearchBox, bool) {
+				atomic.AddInt64(evaluations, 1)
+				return rule(c)
+			}),
+		}, cfg...)...)
+	}
+
+	xc90 := &combind.BackendComponent{Code: "xc90", Type: "model", Props: map[string]interface{}{"brand": "volvo"}}
+	changes := combind.ChangesOf(xc90)
+
+	// the sources are recorded from the first build
+	evaluations := int64(0)
+	vc := component(&evaluations, combind.WithIncremental())
+	_, err := vc.Build(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), evaluations)
+
+	assert.NoError(t, storage.Save(ctx, xc90))
+	evaluations = 0
+	incremental, err := vc.BuildIncremental(ctx, changes)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), evaluations)
+	assert.Equal(t, []string{"9-5", "not-mapped", "v70", "xc90"}, boxKeys(incremental))
+	assert.Nil(t, vc.Provenance("xc90", combind.Key{"brand": "volvo", "model": "xc90"}))
+
+	// otherwise from the first incremental build, which builds in full
+	assert.NoError(t, storage.Delete(ctx, xc90))
+	evaluations = 0
+	vc = component(&evaluations)
+	_, err = vc.Build(ctx, true)
+	assert.NoError(t, err)
+
+	assert.NoError(t, storage.Save(ctx, xc90))
+	evaluations = 0
+	_, err = vc.BuildIncremental(ctx, changes)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), evaluations)
+
+	v70 := &combind.BackendComponent{Code: "v70", Type: "model"}
+	assert.NoError(t, storage.Delete(ctx, v70))
+	evaluations = 0
+	incremental, err = vc.BuildIncremental(ctx, combind.ChangesOf(v70))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), evaluations)
+	assert.Equal(t, []string{"9-5", "not-mapped", "xc90"}, boxKeys(incremental))
+}
+
+func TestBuildIncrementalOverridesKeptProps(t *testing.T) {
+	ctx := context.Background()
+	storage := combind.NewMemoryComponentStorage(
+		&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+		&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+	)
+	brands := func() *combind.VirtualComponent {
+		return combind.NewVirtualComponent("brands", nil, combind.WithContextCombiner(combind.JoinCombiner()),
+			combind.WithDependency(combind.NewRoot("brand", storage)),
+			combind.WithConflictPolicy(combind.ConflictAll),
+			combind.WithRule(func(c *combind.Combination) (*combind.SearchBox, bool) {
+				b := c.Types["brand"]
+				return &combind.SearchBox{
+					Key:     "brands",
+					Type:    "brands",
+					Props:   map[string]interface{}{b.Key: b.Props["name"]},
+					Matches: c.Matches,
+				}, true
+			}),
+		)
+	}
+
+	vc := brands()
+	_, err := vc.Build(ctx, true)
+	assert.NoError(t, err)
+
+	volvo := &combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo Cars"}
+	assert.NoError(t, storage.Save(ctx, volvo))
+
+	incremental, err := vc.BuildIncremental(ctx, combind.ChangesOf(volvo))
+	assert.NoError(t, err)
+	if assert.Len(t, incremental, 1) {
+		assert.Equal(t, map[string]interface{}{"volvo": "Volvo Cars", "saab": "Saab"}, incremental[0].Props)
+		assert.Len(t, incremental[0].Matches, 2)
+	}
+
+	full, err := brands().Build(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, full[0].Props, incremental[0].Props)
+}
+
+func TestBuildEachSendsTheFullBuildAfterOneEvaluation(t *testing.T) {
+	for _, projected := range []bool{false, true} {
+		ctx := context.Background()
+		storage := combind.NewMemoryComponentStorage(
+			&combind.BackendComponent{Code: "volvo", Type: "brand", Name: "Volvo"},
+			&combind.BackendComponent{Code: "saab", Type: "brand", Name: "Saab"},
+			&combind.BackendComponent{Code: "v70", Type: "model", Props: map[string]interface{}{"brand": "volvo"}},
+			&combind.BackendComponent{Code: "xc90", Type: "model", Props: map[string]interface{}{"brand": "volvo"}},
+			&combind.BackendComponent{Code: "9-5", Type: "model", Props: map[string]interface{}{"brand": "saab"}},
+			&combind.BackendComponent{Code: "a4", Type: "model", Props: map[string]interface{}{"brand": "audi"}},
+		)
+
+		evaluations := 0
+		vc := combind.NewVirtualComponent("brand-model", nil,
+			combind.WithContextCombiner(func(ctx context.Context, deps map[string][]*combind.SearchBox) chan *combind.Combination {
+				evaluations++
+				return combind.DependencyMergeContext(ctx, nil, deps["brand"], deps["model"])
+			}),
+			combind.WithDependency(combind.NewRoot("brand", storage), combind.NewRoot("model", storage)),
+			combind.WithRule(brandModelRule(projected)),
+		)
+
+		streamed := map[string]*combind.SearchBox{}
+		sent := []string{}
+		err := vc.BuildEach(ctx, func(sb *combind.SearchBox) error {
+			assert.NotContains(t, streamed, sb.Key)
+			streamed[sb.Key] = sb
+			sent = append(sent, sb.Key)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, evaluations)
+		assert.True(t, sort.StringsAreSorted(sent))
+
+		full, err := brandModelComponent(storage, projected).Build(ctx, true)
+		assert.NoError(t, err)
+
+		built := []*combind.SearchBox{}
+		for _, sb := range streamed {
+			built = append(built, sb)
+		}
+		assert.Contains(t, boxKeys(built), combind.NotMappedKey)
+		assertSameBuild(t, full, built)
+		for _, sb := range full {
+			assert.Len(t, streamed[sb.Key].Matches, len(sb.Matches), sb.Key)
+			assert.Equal(t, sb.Props, streamed[sb.Key].Props, sb.Key)
+		}
+	}
+}